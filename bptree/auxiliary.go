@@ -5,21 +5,38 @@ import (
 	"encoding/binary"
 )
 
-// keyPosLookup finds the first position for a key in a node, and returns the index of it.
+// keyPosLookup finds the last position whose key is less than or equal to the key in a node, and returns the index
+// of it. The first position is a lower bound for any key.
 // It works for both non-leaf nodes and leaf nodes.
-// TODO: binary search
 func keyPosLookup(node Node, key []byte) uint16 {
-	numKeys := node.getNumKeys()
-	index := uint16(0)
-	for i := uint16(1); i < numKeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-		if cmp <= 0 {
-			index = i
+	if node.isIntKeys() {
+		return keyPosLookupInt(node, binary.BigEndian.Uint64(key))
+	}
+	// binary search for the first position whose key is greater than the key in [1, numKeys)
+	lo, hi := uint16(1), node.getNumKeys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if bytes.Compare(node.getKey(mid), key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo - 1
+}
+
+// keyPosLookupInt is keyPosLookup for nodes with the BNODE_INT_KEYS layout, comparing keys as integers.
+func keyPosLookupInt(node Node, key uint64) uint16 {
+	lo, hi := uint16(1), node.getNumKeys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if binary.BigEndian.Uint64(node.getKey(mid)) <= key {
+			lo = mid + 1
 		} else {
-			break
+			hi = mid
 		}
 	}
-	return index
+	return lo - 1
 }
 
 // appendKVRange copies a range of KVs from an old node to a new node, and updates the offset list and pointers in new
@@ -57,6 +74,16 @@ func appendSingleKV(node Node, dstIdx uint16, ptr uint64, key []byte, val []byte
 	node.setPtr(dstIdx, ptr)
 	// database
 	pos := node.getKVPos(dstIdx)
+	if node.isIntKeys() {
+		// the dummy key is nil, which is stored as 0
+		var intKey [8]byte
+		copy(intKey[:], key)
+		copy(node[pos:], intKey[:])
+		binary.LittleEndian.PutUint16(node[pos+8:], uint16(len(val)))
+		copy(node[pos+10:], val)
+		node.setOffset(dstIdx+1, node.getOffset(dstIdx)+uint16(10+len(val)))
+		return
+	}
 	binary.LittleEndian.PutUint16(node[pos:], uint16(len(key)))
 	binary.LittleEndian.PutUint16(node[pos+2:], uint16(len(val)))
 	copy(node[pos+4:], key)
@@ -66,7 +93,7 @@ func appendSingleKV(node Node, dstIdx uint16, ptr uint64, key []byte, val []byte
 }
 
 func nodeUpdateAndReplace(tree *BPlusTree, new Node, old Node, index uint16, kids ...Node) {
-	new.setHeader(BNODE_INTERNAL, old.getNumKeys()+uint16(len(kids))-1)
+	new.setHeader(BNODE_INTERNAL|old.getLayout(), old.getNumKeys()+uint16(len(kids))-1)
 	appendKVRange(new, old, 0, 0, index)
 	for i, kid := range kids {
 		appendSingleKV(new, index+uint16(i), tree.New(kid), kid.getKey(0), nil) // val of internal node is 0
@@ -1,8 +1,11 @@
 package bptree
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
 	"testing"
-	"unsafe"
 )
 
 type C struct {
@@ -13,6 +16,7 @@ type C struct {
 
 func newC() *C {
 	pages := map[uint64]Node{}
+	next := uint64(1)
 	return &C{
 		tree: BPlusTree{
 			Get: func(ptr uint64) Node {
@@ -23,7 +27,8 @@ func newC() *C {
 				return Node{}
 			},
 			New: func(node Node) uint64 {
-				ptr := uint64(uintptr(unsafe.Pointer(&node)))
+				ptr := next
+				next++
 				pages[ptr] = node
 				return ptr
 			},
@@ -93,3 +98,343 @@ func TestBPlusTree_Update(t *testing.T) {
 func TestBPlusTree_Delete(t *testing.T) {
 
 }
+
+func TestBPlusTree_InsertMany(t *testing.T) {
+	c := newC()
+	for i := 0; i < 5000; i++ {
+		c.add(fmt.Sprintf("key%07d", i*7919%5000), fmt.Sprintf("val%d", i))
+	}
+
+	for k, v := range c.ref {
+		val, ok := c.tree.GetVal([]byte(k))
+		if !ok || v != string(val) {
+			t.Fatalf("Failed, %s: %s is not equal to %s", k, v, val)
+		}
+	}
+}
+
+func TestBPlusTree_IntKeys(t *testing.T) {
+	c := newC()
+	c.tree.IntKeys = true
+	for i := uint64(1); i <= 5000; i++ {
+		k := i * 7919 % 5000
+		if k == 0 {
+			continue
+		}
+		c.add(string(U64Key(k)), fmt.Sprintf("val%d", i))
+	}
+
+	for k, v := range c.ref {
+		val, ok := c.tree.GetVal([]byte(k))
+		if !ok || v != string(val) {
+			t.Fatalf("Failed, %d: %s is not equal to %s", binary.BigEndian.Uint64([]byte(k)), v, val)
+		}
+	}
+	if _, ok := c.tree.GetVal([]byte("short")); ok {
+		t.Errorf("key with a bad length found")
+	}
+	if err := c.tree.CheckKey(U64Key(0)); err != ErrBadKey {
+		t.Errorf("reserved key accepted")
+	}
+}
+
+func TestBPlusTree_IntKeysMismatch(t *testing.T) {
+	c := newC()
+	c.tree.IntKeys = true
+	for i := uint64(1); i <= 1000; i++ {
+		c.add(string(U64Key(i)), fmt.Sprintf("val%d", i))
+	}
+
+	// nodes keep their layout when the tree is opened without IntKeys
+	c.tree.IntKeys = false
+	if err := c.tree.CheckKey([]byte("short")); err != ErrBadKey {
+		t.Fatalf("short key accepted: %v", err)
+	}
+	if _, ok := c.tree.GetVal([]byte("short")); ok {
+		t.Fatal("short key found")
+	}
+	if c.tree.Delete([]byte("short")) {
+		t.Fatal("short key deleted")
+	}
+	if iter := c.tree.SeekGE([]byte("short")); !iter.Valid() || !bytes.Equal(iter.Key(), U64Key(1)) {
+		t.Fatal("seek does not start at the first key")
+	}
+	if val, ok := c.tree.GetVal(U64Key(500)); !ok || string(val) != "val500" {
+		t.Fatalf("unexpected value %q", val)
+	}
+}
+
+func TestBPlusTree_EmptyKey(t *testing.T) {
+	c := newC()
+	c.add("key", "val")
+
+	// the empty key is the dummy key of the first leaf
+	if err := c.tree.CheckKey([]byte{}); err != ErrBadKey {
+		t.Fatalf("empty key accepted: %v", err)
+	}
+	if _, ok := c.tree.GetVal(nil); ok {
+		t.Fatal("empty key found")
+	}
+	if c.tree.Delete([]byte{}) {
+		t.Fatal("empty key deleted")
+	}
+	if iter := c.tree.SeekGE([]byte{}); !iter.Valid() || string(iter.Key()) != "key" {
+		t.Fatal("seek does not start at the first key")
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != ErrBadKey {
+				t.Fatalf("unexpected panic %v", r)
+			}
+		}()
+		c.tree.Insert([]byte{}, []byte("val"))
+	}()
+
+	// the dummy key is still there, so the tree survives deleting every key
+	if !c.del("key") {
+		t.Fatal("key not deleted")
+	}
+	c.add("key", "new")
+	if val, ok := c.tree.GetVal([]byte("key")); !ok || string(val) != "new" {
+		t.Fatalf("unexpected value %q", val)
+	}
+}
+
+// benchTree builds a tree with n random 8-byte keys stored in the variable or fixed-width layout.
+func benchTree(intKeys bool, n int) (*C, [][]byte) {
+	c := newC()
+	c.tree.IntKeys = intKeys
+	keys := make([][]byte, n)
+	val := make([]byte, 16)
+	for i := range keys {
+		keys[i] = U64Key(uint64(i)*0x9E3779B97F4A7C15 | 1)
+		c.tree.Insert(keys[i], val)
+	}
+	return c, keys
+}
+
+func benchmarkInsert(b *testing.B, intKeys bool) {
+	val := make([]byte, 16)
+	c := newC()
+	c.tree.IntKeys = intKeys
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.tree.Insert(U64Key(uint64(i)*0x9E3779B97F4A7C15|1), val)
+	}
+}
+
+func benchmarkGetVal(b *testing.B, intKeys bool) {
+	c, keys := benchTree(intKeys, 100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := c.tree.GetVal(keys[i%len(keys)]); !ok {
+			b.Fatal("key not found")
+		}
+	}
+}
+
+func BenchmarkInsert_VarKeys(b *testing.B) { benchmarkInsert(b, false) }
+func BenchmarkInsert_IntKeys(b *testing.B) { benchmarkInsert(b, true) }
+func BenchmarkGetVal_VarKeys(b *testing.B) { benchmarkGetVal(b, false) }
+func BenchmarkGetVal_IntKeys(b *testing.B) { benchmarkGetVal(b, true) }
+
+func TestBPlusTree_Rewrite(t *testing.T) {
+	c := newC()
+	for i := 0; i < 1000; i++ {
+		c.add(fmt.Sprintf("key%05d", i), fmt.Sprintf("val%d", i))
+	}
+	old := map[uint64]bool{}
+	for ptr := range c.pages {
+		old[ptr] = true
+	}
+
+	c.tree.Rewrite()
+	for ptr := range c.pages {
+		if old[ptr] {
+			t.Fatalf("page %d is not rewritten", ptr)
+		}
+	}
+	for k, v := range c.ref {
+		val, ok := c.tree.GetVal([]byte(k))
+		if !ok || v != string(val) {
+			t.Fatalf("Failed, %s: %s is not equal to %s", k, v, val)
+		}
+	}
+}
+
+func FuzzNodeValidate(f *testing.F) {
+	// seed with nodes of real trees, and damaged copies of them
+	for _, intKeys := range []bool{false, true} {
+		c, _ := benchTree(intKeys, 2000)
+		for _, ptr := range []uint64{c.tree.Root, c.tree.Get(c.tree.Root).getPtr(0)} {
+			node := c.tree.Get(ptr)
+			if err := node.Validate(); err != nil {
+				f.Fatalf("a node of a real tree is rejected: %v", err)
+			}
+			f.Add([]byte(node))
+			damaged := append([]byte{}, node...)
+			binary.LittleEndian.PutUint16(damaged[2:], 0xffff)
+			f.Add(damaged)
+		}
+	}
+	f.Add(make([]byte, PAGE_SIZE))
+	f.Add([]byte{1, 0, 1, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		node := Node(data)
+		if node.Validate() != nil {
+			return
+		}
+		// decoding a valid node never panics
+		for i := uint16(0); i < node.getNumKeys(); i++ {
+			node.getPtr(i)
+			node.getVal(i)
+			keyPosLookup(node, node.getKey(i))
+		}
+	})
+}
+
+func TestBPlusTree_Builder(t *testing.T) {
+	for _, intKeys := range []bool{false, true} {
+		for _, n := range []int{0, 1, 100, 5000} {
+			c := newC()
+			c.tree.IntKeys = intKeys
+			b := c.tree.NewBuilder()
+			for i := 1; i <= n; i++ {
+				key := []byte(fmt.Sprintf("key%05d", i))
+				if intKeys {
+					key = U64Key(uint64(i))
+				}
+				if err := b.Add(key, []byte(fmt.Sprintf("val%d", i))); err != nil {
+					t.Fatal(err)
+				}
+				c.ref[string(key)] = fmt.Sprintf("val%d", i)
+			}
+			for k := range c.ref {
+				if b.Add([]byte(k), nil) == nil {
+					t.Fatalf("key out of order is added")
+				}
+			}
+			b.Finish()
+
+			for k, v := range c.ref {
+				val, ok := c.tree.GetVal([]byte(k))
+				if !ok || v != string(val) {
+					t.Fatalf("Failed, %s: %s is not equal to %s", k, v, val)
+				}
+			}
+			// the tree is still usable
+			key := []byte("zzz")
+			if intKeys {
+				key = U64Key(uint64(n + 1))
+			}
+			c.add(string(key), "last")
+			if val, ok := c.tree.GetVal(key); !ok || string(val) != "last" {
+				t.Fatalf("key inserted after building is not found")
+			}
+			for ptr, node := range c.pages {
+				if err := node.Validate(); err != nil {
+					t.Fatalf("node %d: %v", ptr, err)
+				}
+			}
+		}
+	}
+}
+
+func TestBPlusTree_Iter(t *testing.T) {
+	for _, intKeys := range []bool{false, true} {
+		c, keys := benchTree(intKeys, 3000)
+		prefetched := 0
+		c.tree.Prefetch = func(ptrs []uint64) { prefetched += len(ptrs) }
+
+		n, prev := 0, []byte(nil)
+		for iter := c.tree.SeekGE(nil); iter.Valid(); iter.Next() {
+			if prev != nil && bytes.Compare(prev, iter.Key()) >= 0 {
+				t.Fatalf("%x after %x", iter.Key(), prev)
+			}
+			n, prev = n+1, iter.Key()
+		}
+		if n != len(keys) || prefetched == 0 {
+			t.Fatalf("%d keys iterated out of %d, %d prefetched", n, len(keys), prefetched)
+		}
+
+		sorted := append([][]byte{}, keys...)
+		sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+		for _, i := range []int{0, 1, 1234, len(sorted) - 1} {
+			if iter := c.tree.SeekGE(sorted[i]); !iter.Valid() || !bytes.Equal(iter.Key(), sorted[i]) {
+				t.Fatalf("SeekGE(%x) is not at the key", sorted[i])
+			}
+			// keys are odd
+			below := U64Key(binary.BigEndian.Uint64(sorted[i]) - 1)
+			if iter := c.tree.SeekGE(below); !iter.Valid() || !bytes.Equal(iter.Key(), sorted[i]) {
+				t.Fatalf("SeekGE(%x) is not at the next key", below)
+			}
+		}
+		iter := c.tree.SeekGE(sorted[len(sorted)-1])
+		if iter.Next(); iter.Valid() {
+			t.Fatalf("iterator is valid after the last key")
+		}
+	}
+}
+
+// leafFill returns the fill factors of the leaves of a tree in key order.
+func (c *C) leafFill() []float64 {
+	fill := []float64{}
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node := c.tree.Get(ptr)
+		if node.Type() == BNODE_LEAF {
+			fill = append(fill, float64(node.Size())/PAGE_SIZE)
+			return
+		}
+		for i := uint16(0); i < node.NumKeys(); i++ {
+			walk(node.Ptr(i))
+		}
+	}
+	walk(c.tree.Root)
+	return fill
+}
+
+func TestBPlusTree_AppendSplit(t *testing.T) {
+	for _, tc := range []struct {
+		fillFactor float64
+		intKeys    bool
+		min, max   float64 // of the fill of leaves but the last one
+	}{{0, false, 0.97, 1}, {0, true, 0.97, 1}, {0.75, false, 0.7, 0.76}} {
+		c := newC()
+		c.tree.IntKeys, c.tree.FillFactor = tc.intKeys, tc.fillFactor
+		for i := uint64(1); i <= 20000; i++ {
+			key := fmt.Sprintf("ts%010d", i)
+			if tc.intKeys {
+				key = string(U64Key(i))
+			}
+			c.add(key, fmt.Sprintf("val%d", i))
+		}
+		fill := c.leafFill()
+		sum := 0.0
+		for _, f := range fill[:len(fill)-1] {
+			if f < tc.min || f > tc.max {
+				t.Fatalf("fill factor %v, int keys %v: leaf filled to %.3f", tc.fillFactor, tc.intKeys, f)
+			}
+			sum += f
+		}
+		t.Logf("fill factor %v, int keys %v: %d leaves, %.1f%% average fill", tc.fillFactor, tc.intKeys, len(fill),
+			100*sum/float64(len(fill)-1))
+		for k, v := range c.ref {
+			if val, ok := c.tree.GetVal([]byte(k)); !ok || v != string(val) {
+				t.Fatalf("Failed, %q: %s is not equal to %s", k, v, val)
+			}
+		}
+	}
+
+	// splits not at the end are balanced
+	c := newC()
+	for i := 0; i < 20000; i++ {
+		c.add(fmt.Sprintf("key%07d", i*7919%20000), fmt.Sprintf("val%d", i))
+	}
+	for _, f := range c.leafFill() {
+		if f < 0.45 {
+			t.Fatalf("leaf filled to %.3f", f)
+		}
+	}
+}
@@ -7,7 +7,15 @@ func (tree *BPlusTree) Delete(key []byte) bool {
 		return false
 	}
 	root := tree.Get(tree.Root)
+	if tree.checkKey(root, key) != nil {
+		return false
+	}
 	new := kvDelete(tree, root, key)
+	if len(new) == 0 {
+		// not found
+		return false
+	}
+	tree.Del(tree.Root)
 	if new.getNodeType() == BNODE_INTERNAL && new.getNumKeys() == 1 {
 		tree.Root = new.getPtr(0)
 	} else {
@@ -35,7 +43,7 @@ func kvDelete(tree *BPlusTree, node Node, key []byte) Node {
 }
 
 func leafDelete(new Node, old Node, index uint16) {
-	new.setHeader(BNODE_LEAF, old.getNumKeys()-1)
+	new.setHeader(BNODE_LEAF|old.getLayout(), old.getNumKeys()-1)
 	appendKVRange(new, old, 0, 0, index)
 	appendKVRange(new, old, index, index+1, old.getNumKeys()-1-index)
 }
@@ -99,7 +107,7 @@ func nodeCheckMergeable(tree *BPlusTree, new Node, node Node, index uint16) (int
 }
 
 func nodeMerge(merged Node, left Node, right Node) {
-	merged.setHeader(left.getNodeType(), left.getNumKeys()+right.getNumKeys())
+	merged.setHeader(left.getNodeType()|left.getLayout(), left.getNumKeys()+right.getNumKeys())
 	appendKVRange(merged, left, 0, 0, left.getNumKeys())
 	appendKVRange(merged, right, left.getNumKeys(), 0, right.getNumKeys())
 }
@@ -107,7 +115,7 @@ func nodeMerge(merged Node, left Node, right Node) {
 // nodeReplace2Kid updates the new node with merged node and the rest of kid nodes of the old node.
 // It accepts a pointer and the key of the merged node, and the index of the left old kid node.
 func nodeReplace2Kid(new Node, old Node, index uint16, merged uint64, key []byte) {
-	new.setHeader(BNODE_INTERNAL, old.getNumKeys()-1)
+	new.setHeader(BNODE_INTERNAL|old.getLayout(), old.getNumKeys()-1)
 	appendKVRange(new, old, 0, 0, index)
 	appendSingleKV(new, index, merged, key, []byte{})
 	appendKVRange(new, old, index+1, index+2, old.getNumKeys()-index-2)
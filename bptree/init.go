@@ -11,6 +11,8 @@ const (
 
 var (
 	ErrUntypedNode = errors.New("node without a type")
+	ErrBadKey      = errors.New("key does not fit the node layout")
+	ErrBadNode     = errors.New("malformed node")
 )
 
 func init() {
@@ -9,11 +9,15 @@ NODES ARE IMMUTABLE IN ORDER TO REALIZE CONCURRENCY.
 ALL UPDATING OPERATIONS ARE NOT DONE IN-PLACE, BY DUPLICATING NEW DATA STRUCTURES INSTEAD.
 */
 
+// Insert inserts or updates a key. It panics with ErrBadKey if the key is rejected by CheckKey.
 func (tree *BPlusTree) Insert(key []byte, val []byte) {
 	if tree.Root == 0 {
+		if err := tree.checkKey(nil, key); err != nil {
+			panic(err)
+		}
 		// create the first node
 		root := make(Node, PAGE_SIZE)
-		root.setHeader(BNODE_LEAF, 2)
+		root.setHeader(BNODE_LEAF|tree.layout(), 2)
 		appendSingleKV(root, 0, 0, nil, nil) // dummy key
 		appendSingleKV(root, 1, 0, key, val)
 		tree.Root = tree.New(root)
@@ -21,9 +25,12 @@ func (tree *BPlusTree) Insert(key []byte, val []byte) {
 	}
 
 	root := tree.Get(tree.Root)
+	if err := tree.checkKey(root, key); err != nil {
+		panic(err)
+	}
 	tree.Del(tree.Root)
-	new := kvInsert(tree, root, key, val)
-	nSplit, split := nodeSplit3(new)
+	new, appended := kvInsert(tree, root, key, val, true)
+	nSplit, split := nodeSplit3(new, tree.splitTarget(appended))
 
 	if nSplit == 1 {
 		tree.Root = tree.New(split[0])
@@ -31,8 +38,8 @@ func (tree *BPlusTree) Insert(key []byte, val []byte) {
 	}
 	// else, the new root needs to be split
 	root = make(Node, PAGE_SIZE)
-	root.setHeader(BNODE_INTERNAL, nSplit)
-	for i, kid := range split {
+	root.setHeader(BNODE_INTERNAL|split[0].getLayout(), nSplit)
+	for i, kid := range split[:nSplit] {
 		appendSingleKV(root, uint16(i), tree.New(kid), kid.getKey(0), nil)
 	}
 	tree.Root = tree.New(root)
@@ -43,7 +50,9 @@ func (tree *BPlusTree) Insert(key []byte, val []byte) {
 // the node might be split into 2 nodes.
 // Note that the returned node obtained by the final recursion does not check whether the size is compliant. The caller
 // of the function is responsible to check whether the node needs to be split.
-func kvInsert(tree *BPlusTree, node Node, key []byte, val []byte) Node {
+// It also returns whether the key is appended past the last key of the tree, given whether the node is the rightmost
+// one of its level.
+func kvInsert(tree *BPlusTree, node Node, key []byte, val []byte, rightmost bool) (Node, bool) {
 	new := make([]byte, 2*PAGE_SIZE)
 	index := keyPosLookup(node, key)
 
@@ -52,50 +61,65 @@ func kvInsert(tree *BPlusTree, node Node, key []byte, val []byte) Node {
 		if bytes.Equal(key, node.getKey(index)) {
 			// update the new val to the leaf node
 			leafUpdate(new, node, index, key, val)
-		} else {
-			// insert the new node
-			leafInsert(new, node, index+1, key, val)
+			return new, false
 		}
+		// insert the new node
+		leafInsert(new, node, index+1, key, val)
+		return new, rightmost && index == node.getNumKeys()-1
 	case BNODE_INTERNAL:
-		// recursive insertion to the node
-		intrnNodeInsert(tree, new, node, index+1, key, val)
+		// recursive insertion to the kid node covering the key
+		appended := intrnNodeInsert(tree, new, node, index, key, val, rightmost && index == node.getNumKeys()-1)
+		return new, appended
 	default:
 		// untyped node
-		return make([]byte, 0)
+		return make([]byte, 0), false
 	}
-	return new
 }
 
 func leafInsert(new Node, old Node, index uint16, key []byte, val []byte) {
-	new.setHeader(BNODE_LEAF, old.getNumKeys()+1)
+	new.setHeader(BNODE_LEAF|old.getLayout(), old.getNumKeys()+1)
 	appendKVRange(new, old, 0, 0, index)
 	appendSingleKV(new, index, 0, key, val) // pointer should be set to 0 since we are inserting TERMINAL nodes.
 	appendKVRange(new, old, index+1, index, old.getNumKeys()-index)
 }
 
-func intrnNodeInsert(tree *BPlusTree, new Node, node Node, index uint16, key []byte, val []byte) {
+func intrnNodeInsert(tree *BPlusTree, new Node, node Node, index uint16, key []byte, val []byte, rightmost bool) bool {
 	// deallocate the old node
 	keyPtr := node.getPtr(index)
 	keyNode := tree.Get(node.getPtr(index))
 	tree.Del(keyPtr)
 	// recursive lookup and insertion
-	keyNode = kvInsert(tree, keyNode, key, val)
+	keyNode, appended := kvInsert(tree, keyNode, key, val, rightmost)
 	// split the node if needed
-	numSplit, split := nodeSplit3(keyNode)
+	numSplit, split := nodeSplit3(keyNode, tree.splitTarget(appended))
 
 	// reallocate modified duplicated kid nodes and update links from new node to them
 	nodeUpdateAndReplace(tree, new, node, index, split[:numSplit]...)
+	return appended
 }
 
 func leafUpdate(new Node, old Node, index uint16, key []byte, val []byte) {
-	new.setHeader(BNODE_LEAF, old.getNumKeys())
+	new.setHeader(BNODE_LEAF|old.getLayout(), old.getNumKeys())
 	appendKVRange(new, old, 0, 0, index)
 	appendSingleKV(new, index, 0, key, val)
 	appendKVRange(new, old, index+1, index+1, old.getNumKeys()-index-1)
 }
 
-// nodeSplit3 splits a node into 3 kid nodes, making sure each of them fits into a page.
-func nodeSplit3(node Node) (uint16, [3]Node) {
+// splitTarget returns the size of the left node of a split, packed to the fill factor if the key is appended past the
+// last key of the tree, since the left node is never inserted into again, or 0 for a split at the byte midpoint.
+func (tree *BPlusTree) splitTarget(appended bool) uint16 {
+	if !appended {
+		return 0
+	}
+	if tree.FillFactor <= 0 || tree.FillFactor >= 1 {
+		return PAGE_SIZE
+	}
+	return uint16(tree.FillFactor * PAGE_SIZE)
+}
+
+// nodeSplit3 splits a node into 3 kid nodes, making sure each of them fits into a page. The left node of a split into
+// 2 nodes is packed up to the target size, or balanced with the right one if the target is 0.
+func nodeSplit3(node Node, target uint16) (uint16, [3]Node) {
 	if node.nodeSizeBytes() <= PAGE_SIZE {
 		node = node[:PAGE_SIZE]
 		return 1, [3]Node{node}
@@ -103,34 +127,48 @@ func nodeSplit3(node Node) (uint16, [3]Node) {
 
 	left := make(Node, PAGE_SIZE)
 	right := make(Node, 2*PAGE_SIZE)
-	nodeSplit2(left, right, node)
+	nodeSplit2(left, right, node, nodeSplitIndex(node, target))
 	if right.nodeSizeBytes() <= PAGE_SIZE {
 		right = right[:PAGE_SIZE]
 		return 2, [3]Node{left, right}
 	}
 
+	// packing the left nodes full always leaves a right node fitting into a page
+	clear(left)
+	clear(right)
+	nodeSplit2(left, right, node, nodeSplitIndex(node, PAGE_SIZE))
 	left_ := make(Node, PAGE_SIZE)
 	right_ := make(Node, PAGE_SIZE)
-	nodeSplit2(left_, right_, right)
+	nodeSplit2(left_, right_, right, nodeSplitIndex(right, PAGE_SIZE))
 	return 3, [3]Node{left, left_, right_}
 }
 
-// nodeSplit2 splits a node into two kid nodes, and makes sure that left node fits into one page. The right node may
-// not, so it's the caller's responsible to split the oversize node again.
-func nodeSplit2(left, right, node Node) {
-	var idx uint16
-	for idx = 1; idx < node.getNumKeys(); idx++ {
-		lenLeft := BTNODE_HEADER + (8+2+4)*idx + node.getOffset(idx)
-		if lenLeft > PAGE_SIZE {
-			break
+// nodeSplitIndex returns the amount of KVs of the left node of a split, which fits into a page. The left node takes
+// as many KVs as fit into the target size, at least one, or the KVs leaving the larger node the smallest if the target
+// is 0.
+func nodeSplitIndex(node Node, target uint16) uint16 {
+	n := node.getNumKeys()
+	sizeLeft := func(idx uint16) int { return BTNODE_HEADER + 10*int(idx) + int(node.getOffset(idx)) }
+	sizeRight := func(idx uint16) int {
+		return BTNODE_HEADER + 10*int(n-idx) + int(node.getOffset(n)) - int(node.getOffset(idx))
+	}
+
+	best := uint16(1)
+	for idx := uint16(2); idx < n && sizeLeft(idx) <= PAGE_SIZE; idx++ {
+		if target > 0 && sizeLeft(idx) <= int(target) ||
+			target == 0 && max(sizeLeft(idx), sizeRight(idx)) < max(sizeLeft(best), sizeRight(best)) {
+			best = idx
 		}
 	}
-	idx = idx - 1
+	return best
+}
 
+// nodeSplit2 splits a node into two kid nodes, the left one taking the first idx KVs.
+func nodeSplit2(left, right, node Node, idx uint16) {
 	// handle left node
-	left.setHeader(left.getNodeType(), idx)
+	left.setHeader(node.getNodeType()|node.getLayout(), idx)
 	appendKVRange(left, node, 0, 0, idx)
 	// handle right node
-	right.setHeader(right.getNodeType(), node.getNumKeys()-idx)
+	right.setHeader(node.getNodeType()|node.getLayout(), node.getNumKeys()-idx)
 	appendKVRange(right, node, 0, idx, node.getNumKeys()-idx)
 }
@@ -0,0 +1,111 @@
+package bptree
+
+import "bytes"
+
+// Iter is a cursor over the KVs of a tree in key order, skipping the dummy key. The tree must not be modified while
+// iterating.
+type Iter struct {
+	tree *BPlusTree
+	path []Node   // nodes from the root to a leaf
+	pos  []uint16 // positions within the nodes of the path
+}
+
+// SeekGE returns an iterator at the first KV whose key is greater than or equal to the key, or at the first KV if the
+// key is nil.
+func (tree *BPlusTree) SeekGE(key []byte) *Iter {
+	iter := &Iter{tree: tree}
+	if tree.Root == 0 {
+		return iter
+	}
+	if key != nil && tree.CheckKey(key) != nil {
+		key = nil // a key rejected by the layout is below every key
+	}
+	node := tree.Get(tree.Root)
+	for {
+		idx := uint16(0)
+		if key != nil {
+			idx = keyPosLookup(node, key)
+		}
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.getNodeType() == BNODE_LEAF {
+			break
+		}
+		node = tree.Get(node.getPtr(idx))
+		if node.getNodeType() == BNODE_LEAF {
+			iter.prefetch(len(iter.path) - 1)
+		}
+	}
+	if iter.first() || (key != nil && bytes.Compare(iter.Key(), key) < 0) {
+		iter.Next()
+	}
+	return iter
+}
+
+// Valid reports whether the iterator is at a KV.
+func (iter *Iter) Valid() bool {
+	n := len(iter.path)
+	return n > 0 && iter.pos[n-1] < iter.path[n-1].getNumKeys()
+}
+
+// Key returns the key of the KV, which is only valid until the tree is modified.
+func (iter *Iter) Key() []byte {
+	n := len(iter.path)
+	return iter.path[n-1].getKey(iter.pos[n-1])
+}
+
+// Val returns the value of the KV, which is only valid until the tree is modified.
+func (iter *Iter) Val() []byte {
+	n := len(iter.path)
+	return iter.path[n-1].getVal(iter.pos[n-1])
+}
+
+// Next moves the iterator to the next KV.
+func (iter *Iter) Next() {
+	level := len(iter.path) - 1
+	if level < 0 {
+		return
+	}
+	iter.pos[level]++
+	if iter.pos[level] < iter.path[level].getNumKeys() {
+		return
+	}
+	// go up to the first node with a next kid, then down to the leftmost leaf of the kid
+	for level > 0 && iter.pos[level] >= iter.path[level].getNumKeys() {
+		level--
+		iter.pos[level]++
+	}
+	if iter.pos[level] >= iter.path[level].getNumKeys() {
+		return // the end
+	}
+	for ; level < len(iter.path)-1; level++ {
+		if level == len(iter.path)-2 {
+			iter.prefetch(level)
+		}
+		iter.path[level+1] = iter.tree.Get(iter.path[level].getPtr(iter.pos[level]))
+		iter.pos[level+1] = 0
+	}
+}
+
+// first reports whether the iterator is at the dummy key, which is the first KV of the tree.
+func (iter *Iter) first() bool {
+	for _, pos := range iter.pos {
+		if pos != 0 {
+			return false
+		}
+	}
+	return len(iter.path) > 0
+}
+
+// prefetch passes the kids following the current kid of an internal node to the Prefetch callback.
+func (iter *Iter) prefetch(level int) {
+	if iter.tree.Prefetch == nil {
+		return
+	}
+	node := iter.path[level]
+	ptrs := []uint64{}
+	for i := iter.pos[level] + 1; i < node.getNumKeys(); i++ {
+		ptrs = append(ptrs, node.getPtr(i))
+	}
+	iter.tree.Prefetch(ptrs)
+}
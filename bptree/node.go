@@ -5,6 +5,8 @@ import "encoding/binary"
 const (
 	BNODE_INTERNAL = 1 // type of non-leaf node
 	BNODE_LEAF     = 2 // type of leaf node
+
+	BNODE_INT_KEYS = 1 << 8 // layout flag of nodes storing fixed 8-byte integer keys
 )
 
 // Node is the struct for node of B+Tree.
@@ -16,18 +18,63 @@ type Node []byte
 // It uses uint64 for the disk page number.
 type BPlusTree struct {
 	Root uint64
+	// IntKeys makes new nodes use the fixed-width integer key layout, see U64Key.
+	IntKeys bool
+	// FillFactor is the fraction of a page a node is packed to when it is split by a key appended past the last key of
+	// the tree, such as a timestamp or a sequence. Nodes are packed full if it is 0.
+	FillFactor float64
 	// callbacks
 	Get func(uint64) Node      // returns pointer to a B+tree node
 	New func(node Node) uint64 // allocates a new B+tree node and returns its pointer
 	Del func(uint64)           // deallocates a B+tree node
+	// Prefetch is optional, and called by an Iter entering a leaf with the pointers of the following kids of its parent
+	Prefetch func(ptrs []uint64)
+}
+
+// layout returns the layout flags for nodes created from scratch by the tree.
+func (tree *BPlusTree) layout() uint16 {
+	if tree.IntKeys {
+		return BNODE_INT_KEYS
+	}
+	return 0
+}
+
+// CheckKey reports whether a key can be stored in the tree. A key must fit the layout of new nodes, and the layout of
+// the root, which every node of the tree inherits, so a tree whose IntKeys differs from its nodes rejects keys instead
+// of looking them up.
+func (tree *BPlusTree) CheckKey(key []byte) error {
+	var root Node
+	if tree.Root != 0 {
+		root = tree.Get(tree.Root)
+	}
+	return tree.checkKey(root, key)
+}
+
+// checkKey is CheckKey with the root already read, or nil for an empty tree.
+func (tree *BPlusTree) checkKey(root Node, key []byte) error {
+	if !validKey(tree.layout(), key) || root != nil && !validKey(root.getLayout(), key) {
+		return ErrBadKey
+	}
+	return nil
 }
 
 // BTNODE_HEADER stores type of the node and the amount of KVs in this node.
 // Structure of header(4B):
 // nodeType(2B) - numKeys(2B)
+//
+// The high byte of nodeType holds layout flags, which are inherited by nodes derived from the node.
 
 func (node Node) getNodeType() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return binary.LittleEndian.Uint16(node[0:2]) &^ BNODE_INT_KEYS
+}
+
+// getLayout returns the layout flags of the node.
+func (node Node) getLayout() uint16 {
+	return binary.LittleEndian.Uint16(node[0:2]) & BNODE_INT_KEYS
+}
+
+func (node Node) isIntKeys() bool {
+	return node.getLayout() == BNODE_INT_KEYS
 }
 
 func (node Node) getNumKeys() uint16 {
@@ -81,15 +128,25 @@ func (node Node) getKVPos(index uint16) uint16 {
 
 // Structure of every database pair:
 // keyLen(2B) - valLen(2B) - key - val
+//
+// Nodes with the BNODE_INT_KEYS layout store big-endian 8-byte keys without a length header:
+// key(8B) - valLen(2B) - val
 
 func (node Node) getKey(index uint16) []byte {
 	pos := node.getKVPos(index)
+	if node.isIntKeys() {
+		return node[pos:][:8]
+	}
 	keyLen := binary.LittleEndian.Uint16(node[pos:])
 	return node[pos+4:][:keyLen]
 }
 
 func (node Node) getVal(index uint16) []byte {
 	pos := node.getKVPos(index)
+	if node.isIntKeys() {
+		valLen := binary.LittleEndian.Uint16(node[pos+8:])
+		return node[pos+10:][:valLen]
+	}
 	keyLen := binary.LittleEndian.Uint16(node[pos:])
 	valLen := binary.LittleEndian.Uint16(node[pos+2:])
 	return node[pos+4+keyLen:][:valLen]
@@ -99,3 +156,43 @@ func (node Node) getVal(index uint16) []byte {
 func (node Node) nodeSizeBytes() uint16 {
 	return node.getKVPos(node.getNumKeys())
 }
+
+// U64Key encodes an integer as a key of the fixed-width layout. Big-endian keeps the byte order of keys equal to the
+// numeric order. Key 0 is reserved for the dummy key of the first leaf.
+func U64Key(k uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, k)
+	return key
+}
+
+// validKey checks whether a key can be stored in a node with the given layout. The empty key and key 0 are the dummy
+// key of the first leaf in their layouts, so they are rejected.
+func validKey(layout uint16, key []byte) bool {
+	if layout != BNODE_INT_KEYS {
+		return len(key) > 0 && len(key) <= BTREE_MAX_KEY_SIZE
+	}
+	return len(key) == 8 && binary.BigEndian.Uint64(key) != 0
+}
+
+/* accessors for packages walking the tree themselves, nodes must be valid */
+
+// Type returns the type of the node, BNODE_INTERNAL or BNODE_LEAF.
+func (node Node) Type() uint16 { return node.getNodeType() }
+
+// Layout returns the layout flags of the node.
+func (node Node) Layout() uint16 { return node.getLayout() }
+
+// NumKeys returns the amount of KVs in the node.
+func (node Node) NumKeys() uint16 { return node.getNumKeys() }
+
+// Ptr returns the pointer of the index-th kid of an internal node.
+func (node Node) Ptr(index uint16) uint64 { return node.getPtr(index) }
+
+// Key returns the index-th key of the node.
+func (node Node) Key(index uint16) []byte { return node.getKey(index) }
+
+// Val returns the index-th value of a leaf node.
+func (node Node) Val(index uint16) []byte { return node.getVal(index) }
+
+// Size returns the amount of bytes used by the node.
+func (node Node) Size() uint16 { return node.nodeSizeBytes() }
@@ -3,7 +3,13 @@ package bptree
 import "bytes"
 
 func (tree *BPlusTree) GetVal(key []byte) ([]byte, bool) {
+	if tree.Root == 0 {
+		return make([]byte, 0), false
+	}
 	root := tree.Get(tree.Root)
+	if tree.checkKey(root, key) != nil {
+		return make([]byte, 0), false
+	}
 	return getVal(tree, root, key)
 }
 
@@ -0,0 +1,44 @@
+package bptree
+
+// Rewrite copies every node of the tree into newly allocated pages and deallocates the old ones, so no page of the
+// old tree is referenced afterward.
+func (tree *BPlusTree) Rewrite() {
+	tree.Relocate(func(uint64) bool { return true })
+}
+
+// Relocate copies the nodes for which move returns true into newly allocated pages, along with the nodes referencing
+// them up to the root, and deallocates the old pages. Other nodes are left in place.
+func (tree *BPlusTree) Relocate(move func(ptr uint64) bool) {
+	if tree.Root == 0 {
+		return
+	}
+	tree.Root, _ = relocate(tree, tree.Root, move)
+}
+
+// relocate returns the new pointer of a node, and whether it is moved.
+func relocate(tree *BPlusTree, ptr uint64, move func(uint64) bool) (uint64, bool) {
+	node := tree.Get(ptr)
+	var new Node
+	if node.getNodeType() == BNODE_INTERNAL {
+		for i := uint16(0); i < node.getNumKeys(); i++ {
+			kid, moved := relocate(tree, node.getPtr(i), move)
+			if !moved {
+				continue
+			}
+			if new == nil {
+				new = make(Node, PAGE_SIZE)
+				copy(new, node)
+			}
+			new.setPtr(i, kid)
+		}
+	}
+	if new == nil {
+		if !move(ptr) {
+			return ptr, false
+		}
+		new = make(Node, PAGE_SIZE)
+		copy(new, node)
+	}
+	tree.Del(ptr)
+	return tree.New(new), true
+}
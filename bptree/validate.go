@@ -0,0 +1,59 @@
+package bptree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Validate checks the structure of a node read from an untrusted source, and returns an error wrapping ErrBadNode if
+// it is malformed. Decoding a node passing the validation never indexes out of the node.
+func (node Node) Validate() error {
+	if len(node) < PAGE_SIZE {
+		return fmt.Errorf("%w: size %d is less than a page", ErrBadNode, len(node))
+	}
+
+	nodeType := binary.LittleEndian.Uint16(node[0:2])
+	if nodeType&^BNODE_INT_KEYS != BNODE_INTERNAL && nodeType&^BNODE_INT_KEYS != BNODE_LEAF {
+		return fmt.Errorf("%w: bad type %#x", ErrBadNode, nodeType)
+	}
+	numKeys := int(node.getNumKeys())
+	kvBase := BTNODE_HEADER + (8+2)*numKeys
+	if numKeys == 0 || kvBase > PAGE_SIZE {
+		return fmt.Errorf("%w: bad number of keys %d", ErrBadNode, numKeys)
+	}
+
+	// KVs are bounded by offsets, and their headers must agree with offsets
+	kvHeader := 4
+	if node.isIntKeys() {
+		kvHeader = 10
+	}
+	begin := kvBase
+	for i := 0; i < numKeys; i++ {
+		end := kvBase + int(binary.LittleEndian.Uint16(node[BTNODE_HEADER+8*numKeys+2*i:]))
+		if end-begin < kvHeader || end > PAGE_SIZE {
+			return fmt.Errorf("%w: bad offset of key %d", ErrBadNode, i)
+		}
+
+		// the key of the int layout is part of the KV header
+		keyLen, valLen := 0, int(binary.LittleEndian.Uint16(node[begin+8:]))
+		if !node.isIntKeys() {
+			keyLen = int(binary.LittleEndian.Uint16(node[begin:]))
+			valLen = int(binary.LittleEndian.Uint16(node[begin+2:]))
+		}
+		if keyLen > BTREE_MAX_KEY_SIZE || valLen > BTREE_MAX_VAL_SIZE || kvHeader+keyLen+valLen != end-begin {
+			return fmt.Errorf("%w: bad length of key %d", ErrBadNode, i)
+		}
+		if node.getNodeType() == BNODE_INTERNAL && (valLen != 0 || node.getPtr(uint16(i)) == 0) {
+			return fmt.Errorf("%w: bad kid %d", ErrBadNode, i)
+		}
+		begin = end
+	}
+
+	for i := uint16(1); i < uint16(numKeys); i++ {
+		if bytes.Compare(node.getKey(i-1), node.getKey(i)) >= 0 {
+			return fmt.Errorf("%w: key %d is out of order", ErrBadNode, i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"MiSQL/database"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+func init() {
+	commands["backup"] = command{usage: "backup [-key hex -plaintext] [-nochecksum] [-since gen] <file> <out|->", run: backup}
+}
+
+// backup writes a consistent snapshot of a database file, which is decrypted with -plaintext, to a new file or the
+// standard output. With -since, only the pages changed since the backup of the generation are written, see restore.
+// The file is opened read-only, so it must not be opened for writing by another process, which backs up a live
+// database in-process with DB.Backup.
+func backup(args []string) error {
+	db := &database.DB{}
+	fs := newFlags("backup", db)
+	fs.BoolVar(&db.PlaintextBackup, "plaintext", false, "back up an encrypted file, whose pages are written decrypted")
+	since := (*uint64)(nil)
+	fs.Func("since", "generation of an earlier backup, to write the pages changed since", func(s string) error {
+		gen, err := strconv.ParseUint(s, 10, 64)
+		since = &gen
+		return err
+	})
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errFailed
+	}
+	if err := openReadOnly(db, fs.Arg(0)); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w := io.Writer(os.Stdout)
+	if fs.Arg(1) != "-" {
+		out, err := os.OpenFile(fs.Arg(1), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = out
+	}
+	gen := db.Generation()
+	n, err := int64(0), error(nil)
+	if since != nil {
+		n, err = db.BackupSince(*since, w)
+	} else {
+		n, err = db.Backup(w)
+	}
+	if err != nil {
+		if fs.Arg(1) != "-" {
+			_ = os.Remove(fs.Arg(1)) // a partial backup
+		}
+		return err
+	}
+	if out, ok := w.(*os.File); ok && out != os.Stdout {
+		if err := out.Sync(); err != nil {
+			return err
+		}
+		fmt.Printf("%d bytes written\ngeneration: %d\n", n, gen)
+	}
+	return nil
+}
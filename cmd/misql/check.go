@@ -0,0 +1,35 @@
+package main
+
+import (
+	"MiSQL/database"
+	"fmt"
+)
+
+func init() {
+	commands["check"] = command{usage: "check [-key hex] [-nochecksum] <file>", run: check}
+}
+
+// check verifies the integrity of a database file, and fails if any problem is found.
+func check(args []string) error {
+	db := &database.DB{}
+	fs := newFlags("check", db)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errFailed
+	}
+	if err := openReadOnly(db, fs.Arg(0)); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := db.Check()
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	if !report.OK() {
+		return errFailed
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"MiSQL/database"
+	"fmt"
+)
+
+func init() {
+	commands["defrag"] = command{usage: "defrag [-key hex] [-nochecksum] [-start key] [-end key] <file>", run: defrag}
+}
+
+// defrag rewrites the leaves of a key range of a database file into contiguous pages.
+func defrag(args []string) error {
+	db := &database.DB{}
+	fs := newFlags("defrag", db)
+	start := fs.String("start", "", "first key of the range, the first key of the file if empty")
+	end := fs.String("end", "", "key past the range, past the last key of the file if empty")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errFailed
+	}
+	if err := openExisting(db, fs.Arg(0)); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	bound := func(key string) []byte {
+		if key == "" {
+			return nil
+		}
+		return []byte(key)
+	}
+	n, err := db.Defragment(bound(*start), bound(*end))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rewritten: %d pages\n", n)
+	return nil
+}
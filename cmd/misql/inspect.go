@@ -0,0 +1,110 @@
+package main
+
+import (
+	"MiSQL/bptree"
+	"MiSQL/database"
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+func init() {
+	commands["inspect"] = command{
+		usage: "inspect [-key hex] [-nochecksum] <file> meta | page <n> | freelist | tree [-dot]",
+		run:   inspect,
+	}
+}
+
+// inspect prints the meta page, a decoded page, the freelists, or the B+ tree of a database file.
+func inspect(args []string) error {
+	db := &database.DB{}
+	fs := newFlags("inspect", db)
+	_ = fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errFailed
+	}
+	if err := openReadOnly(db, fs.Arg(0)); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	args = fs.Args()[2:]
+	switch fs.Arg(1) {
+	case "meta":
+		fmt.Print(db.InspectMeta())
+		return nil
+	case "page":
+		if len(args) != 1 {
+			fs.Usage()
+			return errFailed
+		}
+		page, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		info, err := db.InspectPage(page)
+		if err != nil {
+			return err
+		}
+		fmt.Print(info)
+		return nil
+	case "freelist":
+		return inspectFreeLists(db)
+	case "tree":
+		tfs := flag.NewFlagSet("misql inspect tree", flag.ExitOnError)
+		dot := tfs.Bool("dot", false, "render the tree as Graphviz DOT")
+		_ = tfs.Parse(args)
+		if *dot {
+			return inspectDot(db)
+		}
+		return inspectText(db)
+	}
+	fs.Usage()
+	return errFailed
+}
+
+func inspectFreeLists(db *database.DB) error {
+	lists, err := db.InspectFreeLists()
+	if err != nil {
+		return err
+	}
+	for _, list := range lists {
+		if list.Sectors == database.PAGE_SECTORS {
+			fmt.Printf("pages: %d nodes, %d free\n", len(list.Nodes), len(list.Items))
+		} else {
+			fmt.Printf("extents of %d sectors: %d nodes, %d free\n", list.Sectors, len(list.Nodes), len(list.Items))
+		}
+		fmt.Printf("  nodes: %v\n", list.Nodes)
+		fmt.Printf("  free: %v\n", list.Items)
+	}
+	return nil
+}
+
+// nodeLabel describes a node by its kind and its range of keys.
+func nodeLabel(ptr uint64, node bptree.Node) string {
+	kind := "leaf"
+	if node.Type() == bptree.BNODE_INTERNAL {
+		kind = "internal"
+	}
+	return fmt.Sprintf("%d %s, %d keys [%q, %q]", ptr, kind, node.NumKeys(), node.Key(0), node.Key(node.NumKeys()-1))
+}
+
+func inspectText(db *database.DB) error {
+	return db.InspectTree(func(ptr uint64, parent uint64, depth int, node bptree.Node) {
+		fmt.Printf("%*s%s\n", 2*depth, "", nodeLabel(ptr, node))
+	})
+}
+
+func inspectDot(db *database.DB) error {
+	fmt.Println("digraph tree {")
+	fmt.Println("  node [shape=box];")
+	err := db.InspectTree(func(ptr uint64, parent uint64, depth int, node bptree.Node) {
+		fmt.Printf("  n%d [label=%s];\n", ptr, strconv.Quote(nodeLabel(ptr, node)))
+		if parent != 0 {
+			fmt.Printf("  n%d -> n%d;\n", parent, ptr)
+		}
+	})
+	fmt.Println("}")
+	return err
+}
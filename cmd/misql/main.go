@@ -0,0 +1,91 @@
+// Command misql works with MiSQL database files offline.
+//
+// Usage:
+//
+//	misql <command> [flags] <args>
+package main
+
+import (
+	"MiSQL/database"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a subcommand of misql.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{}
+
+// errFailed makes misql exit with failure after a command has reported the reason itself.
+var errFailed = errors.New("failed")
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		if err != errFailed {
+			fmt.Fprintf(os.Stderr, "misql %s: %v\n", os.Args[1], err)
+		}
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "usage: misql <command> [flags] <args>")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	os.Exit(2)
+}
+
+// newFlags returns the flag set of a command, with the flags opening a database file.
+func newFlags(name string, db *database.DB) *flag.FlagSet {
+	fs := flag.NewFlagSet("misql "+name, flag.ExitOnError)
+	keyFlag(fs, &db.Key)
+	fs.BoolVar(&db.NoChecksum, "nochecksum", false, "do not verify checksums of pages")
+	fs.IntVar(&db.BufferPool, "pool", 0, "read pages through a buffer pool of `n` pages instead of the mmap")
+	fs.BoolVar(&db.DirectIO, "direct", false, "bypass the page cache of the kernel with direct I/O")
+	fs.BoolVar(&db.IOUring, "uring", false, "submit the writes of commits to an io_uring")
+	fs.IntVar(&db.SpillPages, "spill", 0, "spill pending pages of a commit beyond `n` pages to a scratch file")
+	return fs
+}
+
+// keyFlag defines the flag of the hex-encoded key of an encrypted file.
+func keyFlag(fs *flag.FlagSet, key *[]byte) {
+	fs.Func("key", "hex-encoded key of an encrypted file", func(s string) (err error) {
+		*key, err = hex.DecodeString(s)
+		return err
+	})
+}
+
+// openExisting opens an existing database file, which Open would create otherwise.
+func openExisting(db *database.DB, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db.Path = path
+	return db.Open()
+}
+
+// openReadOnly opens an existing database file for reading only, so neither the file nor its sidecar files change.
+func openReadOnly(db *database.DB, path string) error {
+	db.ReadOnly = true
+	return openExisting(db, path)
+}
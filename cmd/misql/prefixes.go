@@ -0,0 +1,49 @@
+package main
+
+import (
+	"MiSQL/database"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+func init() {
+	commands["prefixes"] = command{
+		usage: "prefixes [-key hex] [-nochecksum] [-len n | -delim s] [-json] <file>",
+		run:   prefixes,
+	}
+}
+
+// prefixes prints the space taken by keys by their prefixes, the largest first.
+func prefixes(args []string) error {
+	db := &database.DB{}
+	fs := newFlags("prefixes", db)
+	opts := database.PrefixOptions{}
+	fs.IntVar(&opts.Length, "len", 0, "bucket keys by their first bytes")
+	fs.Func("delim", "bucket keys up to and including a delimiter", func(s string) error {
+		opts.Delimiter = []byte(s)
+		return nil
+	})
+	asJSON := fs.Bool("json", false, "print as JSON")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errFailed
+	}
+	if err := openReadOnly(db, fs.Arg(0)); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r, err := db.SpaceByPrefix(opts)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	fmt.Print(r)
+	return nil
+}
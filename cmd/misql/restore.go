@@ -0,0 +1,88 @@
+package main
+
+import (
+	"MiSQL/database"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+func init() {
+	commands["restore"] = command{usage: "restore [-to-time RFC3339 -archive file] <base> <out> [delta...]", run: restore}
+}
+
+// restore copies a full backup to a new file, applies deltas written by backup -since in order, replays the commits
+// archived next to a database file up to an instant, and checks the result.
+func restore(args []string) error {
+	fs := flag.NewFlagSet("misql restore", flag.ExitOnError)
+	to := time.Time{}
+	fs.Func("to-time", "instant to replay archived commits up to, in RFC 3339", func(s string) (err error) {
+		to, err = time.Parse(time.RFC3339Nano, s)
+		return err
+	})
+	archive := fs.String("archive", "", "database file whose archived commits are replayed")
+	_ = fs.Parse(args)
+	if fs.NArg() < 2 || (*archive == "") != to.IsZero() {
+		fs.Usage()
+		return errFailed
+	}
+	args = fs.Args()
+
+	if err := copyNew(args[0], args[1]); err != nil {
+		return err
+	}
+	for _, path := range args[2:] {
+		delta, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = database.ApplyDelta(args[1], delta)
+		_ = delta.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	db := &database.DB{}
+	if err := openExisting(db, args[1]); err != nil {
+		return err
+	}
+	defer db.Close()
+	if *archive != "" {
+		report, err := db.RestoreToTime(*archive, to)
+		if err != nil {
+			return err
+		}
+		fmt.Print(report)
+	}
+	report, err := db.Check()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("generation: %d\n", db.Generation())
+	fmt.Print(report)
+	if !report.OK() {
+		return errFailed
+	}
+	return nil
+}
+
+// copyNew copies a file to a path which must not exist.
+func copyNew(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"MiSQL/database"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func init() {
+	commands["salvage"] = command{usage: "salvage [-key hex] <in> <out>", run: salvage}
+}
+
+// salvage recovers KVs of a damaged file into a new file, which is encrypted with the same key.
+func salvage(args []string) error {
+	key := []byte(nil)
+	fs := flag.NewFlagSet("misql salvage", flag.ExitOnError)
+	keyFlag(fs, &key)
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errFailed
+	}
+	if _, err := os.Stat(fs.Arg(1)); err == nil {
+		return fmt.Errorf("%s already exists", fs.Arg(1))
+	}
+
+	dst := &database.DB{Path: fs.Arg(1), Key: key}
+	if err := dst.Open(); err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	report, err := database.Salvage(fs.Arg(0), key, dst)
+	if report != nil {
+		fmt.Print(report)
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"MiSQL/database"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+func init() {
+	commands["stats"] = command{usage: "stats [-key hex] [-nochecksum] [-json] <file>", run: stats}
+}
+
+// stats prints statistics of the tree and the storage of a database file.
+func stats(args []string) error {
+	db := &database.DB{}
+	fs := newFlags("stats", db)
+	asJSON := fs.Bool("json", false, "print as JSON")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errFailed
+	}
+	if err := openReadOnly(db, fs.Arg(0)); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	}
+	fmt.Print(s)
+	return nil
+}
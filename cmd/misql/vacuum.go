@@ -0,0 +1,49 @@
+package main
+
+import (
+	"MiSQL/database"
+	"fmt"
+	"os"
+)
+
+func init() {
+	commands["vacuum"] = command{usage: "vacuum [-key hex] [-nochecksum] <in> <out>", run: vacuum}
+}
+
+// vacuum rewrites a database file into a new file in the same mode, and reports the bytes reclaimed.
+func vacuum(args []string) error {
+	src := &database.DB{}
+	fs := newFlags("vacuum", src)
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errFailed
+	}
+	if _, err := os.Stat(fs.Arg(1)); err == nil {
+		return fmt.Errorf("%s already exists", fs.Arg(1))
+	}
+	if err := openReadOnly(src, fs.Arg(0)); err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst := &database.DB{Path: fs.Arg(1), Compress: src.Compress, IntKeys: src.IntKeys, NoChecksum: src.NoChecksum, Key: src.Key}
+	if err := dst.Open(); err != nil {
+		return err
+	}
+	defer dst.Close()
+	if err := src.Vacuum(dst); err != nil {
+		return err
+	}
+
+	before, err := os.Stat(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	after, err := os.Stat(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("before: %d bytes\nafter: %d bytes\nreclaimed: %d bytes\n", before.Size(), after.Size(), before.Size()-after.Size())
+	return nil
+}
@@ -0,0 +1,300 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+
+Commit archive
+
+With DB.Archive, every commit of Set and Del appends its KV with the commit time to a log segment next to the
+database file, so a backup can be brought forward to any instant by RestoreToTime. Other commits, such as Compact,
+change no KV, and append an ARCHIVE_NOP record, so every generation is in the archive. Segments are rotated when they
+reach DB.ArchiveSegmentSize, and named by the generation they start after:
+Path+ARCHIVE_SUFFIX+".<start>": ARCHIVE_SIG(16B) - start(8B) - record - record - ...
+record: checksum(4B) - generation(8B) - time(8B) - op(1B) - key size(2B) - val size(2B) - key - val
+A segment holds every commit after its start. A group commit appends a record per write, with the same generation
+and time, see group.go. The checksum is the CRC32C of the rest of the record, so a record torn by a crash ends the
+segment.
+
+Records are synced with the pages of their commit, before the meta page is written, so a committed generation is
+never missing from the archive. A crash before the meta page is written leaves records of a generation above the
+commit of the file, which are truncated when the file is opened again, along with a torn record. Commits made while
+the archive is disabled are not archived, which leaves a gap before the next segment, and restoring beyond a gap fails.
+Records are neither encrypted nor checksummed beyond torn writes, as backups.
+
+*/
+
+const (
+	ARCHIVE_SUFFIX       = ".arch"
+	ARCHIVE_SIG          = "MiSQLArchiveLog"
+	ARCHIVE_HEADER       = 16 + 8
+	ARCHIVE_RECORD       = 4 + 8 + 8 + 1 + 2 + 2 // record header
+	ARCHIVE_SEGMENT_SIZE = 16 << 20              // default size of segments
+
+	ARCHIVE_SET = 1
+	ARCHIVE_DEL = 2
+	ARCHIVE_NOP = 3 // a commit changing no KV
+)
+
+// archiveRecord is a commit read from a segment.
+type archiveRecord struct {
+	gen  uint64
+	time time.Time
+	op   byte
+	key  []byte
+	val  []byte
+}
+
+// archiveSegment is a segment file, with the generation it starts after.
+type archiveSegment struct {
+	path  string
+	start uint64
+}
+
+// archiveSegments lists the segments of a database file, ordered by start.
+func archiveSegments(path string) ([]archiveSegment, error) {
+	names, err := filepath.Glob(path + ARCHIVE_SUFFIX + ".*")
+	if err != nil {
+		return nil, fmt.Errorf("archiveSegments: %w", err)
+	}
+	segments := []archiveSegment{}
+	for _, name := range names {
+		start, err := strconv.ParseUint(strings.TrimPrefix(name, path+ARCHIVE_SUFFIX+"."), 10, 64)
+		if err == nil {
+			segments = append(segments, archiveSegment{path: name, start: start})
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].start < segments[j].start })
+	return segments, nil
+}
+
+// archiveRead reads the records of a segment up to the first torn one, and returns the size of the valid part.
+func archiveRead(path string) (start uint64, records []archiveRecord, size int64, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("archiveRead: %w", err)
+	}
+	sig := [16]byte{}
+	copy(sig[:], ARCHIVE_SIG)
+	if len(data) < ARCHIVE_HEADER || !bytes.Equal(data[:16], sig[:]) {
+		return 0, nil, 0, fmt.Errorf("archiveRead: %s: bad header", path)
+	}
+	start = binary.LittleEndian.Uint64(data[16:])
+
+	off := ARCHIVE_HEADER
+	for off+ARCHIVE_RECORD <= len(data) {
+		header := data[off : off+ARCHIVE_RECORD]
+		end := off + ARCHIVE_RECORD + int(binary.LittleEndian.Uint16(header[21:])) + int(binary.LittleEndian.Uint16(header[23:]))
+		if end > len(data) || crc32.Checksum(data[off+4:end], crcTable) != binary.LittleEndian.Uint32(header) {
+			break
+		}
+		key := data[off+ARCHIVE_RECORD : off+ARCHIVE_RECORD+int(binary.LittleEndian.Uint16(header[21:]))]
+		records = append(records, archiveRecord{
+			gen:  binary.LittleEndian.Uint64(header[4:]),
+			time: time.Unix(0, int64(binary.LittleEndian.Uint64(header[12:]))),
+			op:   header[20],
+			key:  key,
+			val:  data[off+ARCHIVE_RECORD+len(key) : end],
+		})
+		off = end
+	}
+	return start, records, int64(off), nil
+}
+
+// archiveInit opens the last segment to append, truncating a torn record and records of generations not committed, or
+// starts a new segment if commits are missing from it.
+func archiveInit(db *DB) error {
+	if !db.Archive || db.ReadOnly {
+		return nil
+	}
+	segments, err := archiveSegments(db.Path)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return archiveRotate(db, db.gens.commit)
+	}
+
+	last := segments[len(segments)-1]
+	start, records, _, err := archiveRead(last.path)
+	if err != nil {
+		return fmt.Errorf("archiveInit: %w", err)
+	}
+	covered, size := start, int64(ARCHIVE_HEADER)
+	for _, r := range records {
+		if r.gen > db.gens.commit {
+			break // the meta page of the commit is not written
+		}
+		covered, size = r.gen, size+int64(ARCHIVE_RECORD+len(r.key)+len(r.val))
+	}
+	if covered < db.gens.commit {
+		// commits made without the archive are missing
+		return archiveRotate(db, db.gens.commit)
+	}
+
+	fp, err := os.OpenFile(last.path, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("archiveInit: %w", err)
+	}
+	if err := fp.Truncate(size); err != nil {
+		_ = fp.Close()
+		return fmt.Errorf("archiveInit: %w", err)
+	}
+	db.archive.fp, db.archive.size = fp, size
+	return nil
+}
+
+// archiveRotate starts a new segment holding commits after the given generation.
+func archiveRotate(db *DB, start uint64) error {
+	if db.archive.fp != nil {
+		if err := db.archive.fp.Close(); err != nil {
+			return fmt.Errorf("archiveRotate: %w", err)
+		}
+		db.archive.fp = nil
+	}
+	path := fmt.Sprintf("%s%s.%020d", db.Path, ARCHIVE_SUFFIX, start)
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("archiveRotate: %w", err)
+	}
+	header := make([]byte, ARCHIVE_HEADER)
+	copy(header, ARCHIVE_SIG)
+	binary.LittleEndian.PutUint64(header[16:], start)
+	if _, err := fp.Write(header); err != nil {
+		_ = fp.Close()
+		return fmt.Errorf("archiveRotate: %w", err)
+	}
+	db.archive.fp, db.archive.size = fp, ARCHIVE_HEADER
+	return nil
+}
+
+// archiveAppend appends the KVs of the commit being synced to the archive, or an ARCHIVE_NOP record if there is none,
+// with the generation and the time of the commit.
+func archiveAppend(db *DB) error {
+	if db.archive.fp == nil {
+		return nil
+	}
+	limit := int64(db.ArchiveSegmentSize)
+	if limit <= 0 {
+		limit = ARCHIVE_SEGMENT_SIZE
+	}
+	if db.archive.size >= limit {
+		if err := archiveRotate(db, db.gens.commit); err != nil {
+			return err
+		}
+	}
+
+	records := db.archive.pending
+	if len(records) == 0 {
+		records = []archiveRecord{{op: ARCHIVE_NOP}}
+	}
+	data := []byte{}
+	now := uint64(time.Now().UnixNano())
+	for _, r := range records {
+		record := make([]byte, ARCHIVE_RECORD+len(r.key)+len(r.val))
+		binary.LittleEndian.PutUint64(record[4:], db.gens.commit+1)
+		binary.LittleEndian.PutUint64(record[12:], now)
+		record[20] = r.op
+		binary.LittleEndian.PutUint16(record[21:], uint16(len(r.key)))
+		binary.LittleEndian.PutUint16(record[23:], uint16(len(r.val)))
+		copy(record[ARCHIVE_RECORD:], r.key)
+		copy(record[ARCHIVE_RECORD+len(r.key):], r.val)
+		binary.LittleEndian.PutUint32(record, crc32.Checksum(record[4:], crcTable))
+		data = append(data, record...)
+	}
+
+	if _, err := db.archive.fp.WriteAt(data, db.archive.size); err != nil {
+		_ = db.archive.fp.Truncate(db.archive.size)
+		return fmt.Errorf("archiveAppend: %w", err)
+	}
+	if err := fileSync(db, db.archive.fp); err != nil {
+		_ = db.archive.fp.Truncate(db.archive.size)
+		return fmt.Errorf("archiveAppend: %w", err)
+	}
+	db.archive.size += int64(len(data))
+	return nil
+}
+
+// RestoreReport is the result of RestoreToTime.
+type RestoreReport struct {
+	Base     uint64    // generation of the backup
+	Last     uint64    // generation of the last commit replayed
+	Time     time.Time // time of the last commit replayed
+	Replayed int       // records replayed
+}
+
+func (r *RestoreReport) String() string {
+	return fmt.Sprintf("base: %d\nlast: %d\ntime: %v\nreplayed: %d\n",
+		r.Base, r.Last, r.Time.Format(time.RFC3339Nano), r.Replayed)
+}
+
+// RestoreToTime replays the commits archived next to the database file archive onto an opened backup, from the
+// generation of the backup up to the given instant.
+func (db *DB) RestoreToTime(archive string, to time.Time) (*RestoreReport, error) {
+	gen := db.Generation()
+	segments, err := archiveSegments(archive)
+	if err != nil {
+		return nil, fmt.Errorf("RestoreToTime: %w", err)
+	}
+	if len(segments) == 0 {
+		return nil, errors.New("RestoreToTime: no archive")
+	}
+	report := &RestoreReport{Base: gen}
+
+	// the generation up to which commits are known
+	covered := uint64(0)
+	for i, segment := range segments {
+		start, records, _, err := archiveRead(segment.path)
+		if err != nil {
+			return report, fmt.Errorf("RestoreToTime: %w", err)
+		}
+		if i == 0 && start > gen {
+			return report, fmt.Errorf("RestoreToTime: archive starts after generation %d of the backup", gen)
+		}
+		if i > 0 && start > covered {
+			return report, fmt.Errorf("RestoreToTime: archive has a gap after generation %d", covered)
+		}
+		covered = max(covered, start)
+
+		for _, r := range records {
+			if r.time.After(to) {
+				if r.gen > gen {
+					return report, nil
+				}
+				if r.op != ARCHIVE_NOP {
+					return report, errors.New("RestoreToTime: the backup is taken after the instant")
+				}
+			}
+			covered = r.gen
+			if r.gen <= gen || r.op == ARCHIVE_NOP {
+				continue
+			}
+			switch r.op {
+			case ARCHIVE_SET:
+				err = db.Set(r.key, r.val)
+			case ARCHIVE_DEL:
+				_, err = db.Del(r.key)
+			default:
+				err = fmt.Errorf("bad op %d", r.op)
+			}
+			if err != nil {
+				return report, fmt.Errorf("RestoreToTime: generation %d: %w", r.gen, err)
+			}
+			report.Last, report.Time = r.gen, r.time
+			report.Replayed++
+		}
+	}
+	return report, nil
+}
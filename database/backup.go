@@ -0,0 +1,447 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+
+Online backup
+
+Backup pins the root of the current commit, and streams the pages reachable from it in page order, while other
+goroutines keep reading and writing between pages. Pages freed by commits are not reused while a backup is pinned,
+they are kept aside and freed by the first commit after the last backup. If the process stops before, they are leaked
+until the file is compacted.
+
+The backup keeps page numbers of the file, so it is a valid file by itself: its meta page is synthesized, and the
+pages not reachable are free, with freelist nodes stored in some of them. With compression, the free sectors of pages
+holding reachable extents are free extents.
+
+Backups are neither encrypted nor checksummed: pages of an encrypted file are written decrypted, so an encrypted file
+is only backed up with DB.PlaintextBackup, and the stream should be protected by the caller.
+
+The meta page of a backup records the generation of the pinned commit. BackupSince writes a delta holding the pages
+tagged with a later generation, so a chain of deltas applied in order onto a full backup gives the backup of the last
+delta. A delta is a header followed by records of pages:
+header: DELTA_SIG(16B) - since(8B) - generation(8B) - amount of pages(8B) - amount of records(8B)
+record: page number(8B) - page(PAGE_SIZE)
+The meta page is the last record. Records overwrite pages of the base which may still be referenced by its meta page,
+so deltas are applied onto a copy of the base.
+
+*/
+
+var (
+	ErrBackupPinned    = errors.New("a backup is in progress")
+	ErrBackupEncrypted = errors.New("backups of encrypted files are plaintext")
+)
+
+const (
+	DELTA_SIG    = "MiSQLDeltaPages"
+	DELTA_HEADER = 48 // signature(16B), since(8B), generation(8B), amount of pages(8B), amount of records(8B)
+)
+
+// Backup writes a consistent snapshot of the database, which is a valid database file, and returns the amount of
+// bytes written.
+func (db *DB) Backup(w io.Writer) (n int64, err error) {
+	b, err := backupPin(db, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer backupUnpin(db)
+
+	write := func(data []byte) error {
+		m, err := w.Write(data)
+		n += int64(m)
+		return err
+	}
+	if err := write(b.meta); err != nil {
+		return n, err
+	}
+	for page := uint64(1); page < b.nPage; page++ {
+		data, err := b.page(page)
+		if err != nil {
+			return n, err
+		}
+		if err := write(data); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// BackupSince writes the pages of a consistent snapshot changed since the commit of the given generation, which is
+// the generation of an earlier backup, and returns the amount of bytes written. See ApplyDelta.
+func (db *DB) BackupSince(gen uint64, w io.Writer) (n int64, err error) {
+	b, err := backupPin(db, &gen)
+	if err != nil {
+		return 0, err
+	}
+	defer backupUnpin(db)
+
+	// freelist nodes are written as well, since the layout of free pages changes
+	pages := []uint64{}
+	for page := uint64(1); page < b.nPage; page++ {
+		if _, ok := b.fl[page]; ok || b.gens[page] > gen {
+			pages = append(pages, page)
+		}
+	}
+	header := make([]byte, DELTA_HEADER)
+	copy(header, DELTA_SIG)
+	binary.LittleEndian.PutUint64(header[16:], gen)
+	binary.LittleEndian.PutUint64(header[24:], b.commit)
+	binary.LittleEndian.PutUint64(header[32:], b.nPage)
+	binary.LittleEndian.PutUint64(header[40:], uint64(len(pages)+1))
+
+	write := func(data []byte) error {
+		m, err := w.Write(data)
+		n += int64(m)
+		return err
+	}
+	if err := write(header); err != nil {
+		return n, err
+	}
+	record := [8]byte{}
+	for _, page := range pages {
+		data, err := b.page(page)
+		if err != nil {
+			return n, err
+		}
+		binary.LittleEndian.PutUint64(record[:], page)
+		if err := write(record[:]); err != nil {
+			return n, err
+		}
+		if err := write(data); err != nil {
+			return n, err
+		}
+	}
+	// the meta page comes last
+	binary.LittleEndian.PutUint64(record[:], 0)
+	if err := write(record[:]); err != nil {
+		return n, err
+	}
+	return n, write(b.meta)
+}
+
+// backupPin pins the current commit, and lays out its backup. Only pages changed after the commit of the given
+// generation are needed if it is not nil.
+func backupPin(db *DB, since *uint64) (*backup, error) {
+	db.mu.Lock()
+	if db.enc.encrypted && !db.PlaintextBackup {
+		db.mu.Unlock()
+		return nil, fmt.Errorf("Backup: %w", ErrBackupEncrypted)
+	}
+	root, nFlushed, commit := db.tree.Root, db.page.nFlushed, db.gens.commit
+	db.backup.pins++
+	db.mu.Unlock()
+
+	if since != nil && *since > commit {
+		backupUnpin(db)
+		return nil, fmt.Errorf("BackupSince: generation %d is after the last commit %d", *since, commit)
+	}
+	b := &backup{db: db, commit: commit, used: map[uint64][PAGE_SECTORS]bool{}, gens: map[uint64]uint64{}}
+	if err := b.walk(root); err != nil {
+		backupUnpin(db)
+		return nil, err
+	}
+	b.meta = b.layout(root, nFlushed)
+	return b, nil
+}
+
+func backupUnpin(db *DB) {
+	db.mu.Lock()
+	db.backup.pins--
+	db.mu.Unlock()
+}
+
+// ApplyDelta applies a delta written by BackupSince onto a backup file, which must be the backup of the generation the
+// delta is taken since, and is not opened.
+func ApplyDelta(path string, r io.Reader) error {
+	header := make([]byte, DELTA_HEADER)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("ApplyDelta: %w", err)
+	}
+	sig := [16]byte{}
+	copy(sig[:], DELTA_SIG)
+	if !bytes.Equal(header[:16], sig[:]) {
+		return errors.New("ApplyDelta: bad signature")
+	}
+	since := binary.LittleEndian.Uint64(header[16:])
+	nPage := binary.LittleEndian.Uint64(header[32:])
+	nRecord := binary.LittleEndian.Uint64(header[40:])
+
+	gen, err := BackupGeneration(path)
+	if err != nil {
+		return fmt.Errorf("ApplyDelta: %w", err)
+	}
+	if gen != since {
+		return fmt.Errorf("ApplyDelta: delta is taken since generation %d, but the base is at %d", since, gen)
+	}
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("ApplyDelta: %w", err)
+	}
+	defer fp.Close()
+
+	record := make([]byte, 8+bptree.PAGE_SIZE)
+	for i := uint64(0); i < nRecord; i++ {
+		if _, err := io.ReadFull(r, record); err != nil {
+			return fmt.Errorf("ApplyDelta: %w", err)
+		}
+		page := binary.LittleEndian.Uint64(record)
+		if page >= nPage || (page == 0) != (i == nRecord-1) {
+			return fmt.Errorf("ApplyDelta: bad record of page %d", page)
+		}
+		if page == 0 {
+			// pages are synced before the meta page
+			if err := fp.Truncate(int64(nPage * bptree.PAGE_SIZE)); err != nil {
+				return fmt.Errorf("ApplyDelta: %w", err)
+			}
+			if err := fp.Sync(); err != nil {
+				return fmt.Errorf("ApplyDelta: %w", err)
+			}
+		}
+		if _, err := fp.WriteAt(record[8:], int64(page*bptree.PAGE_SIZE)); err != nil {
+			return fmt.Errorf("ApplyDelta: %w", err)
+		}
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("ApplyDelta: %w", err)
+	}
+	// sidecar files are rebuilt when the file is opened
+	for _, suffix := range []string{CRC_SUFFIX, GEN_SUFFIX} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("ApplyDelta: %w", err)
+		}
+	}
+	return nil
+}
+
+// BackupGeneration returns the generation of a backup file, or of the last commit of a database file, or the
+// generation a delta is taken at.
+func BackupGeneration(path string) (uint64, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("BackupGeneration: %w", err)
+	}
+	defer fp.Close()
+	data := make([]byte, META_SIZE)
+	if _, err := io.ReadFull(fp, data); err != nil {
+		return 0, fmt.Errorf("BackupGeneration: %w", err)
+	}
+	if bytes.HasPrefix(data, []byte(DELTA_SIG)) {
+		return binary.LittleEndian.Uint64(data[24:]), nil
+	}
+	db := DB{}
+	if err := metaPageDecode(&db, data); err != nil {
+		return 0, fmt.Errorf("BackupGeneration: %w", err)
+	}
+	return db.gens.commit, nil
+}
+
+// backupDefer keeps pages freed by writePages aside while a backup is pinned, or frees the pages kept aside before.
+func backupDefer(db *DB, freed []uint64) []uint64 {
+	if db.backup.pins > 0 {
+		db.page.deferred = freed
+		return nil
+	}
+	db.page.released = len(db.backup.freed) > 0
+	return append(freed, db.backup.freed...)
+}
+
+// backupCommit updates the pages kept aside after writePages is committed.
+func backupCommit(db *DB) {
+	if db.page.released {
+		db.backup.freed = nil
+	}
+	db.backup.freed = append(db.backup.freed, db.page.deferred...)
+}
+
+// backup holds the state of Backup.
+type backup struct {
+	db     *DB
+	commit uint64                        // generation of the pinned commit
+	used   map[uint64][PAGE_SECTORS]bool // reachable pages, by sectors with compression
+	gens   map[uint64]uint64             // generations of reachable pages
+	nPage  uint64
+	fl     map[uint64]bptree.Node // freelist nodes of the backup
+	meta   []byte
+}
+
+// locked reads with a callback under the lock, recovering ErrCorruptPage.
+func (b *backup) locked(read func()) (err error) {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+	defer recoverCorrupt(b.db, metaPageEncode(b.db), &err)
+	read()
+	return nil
+}
+
+// walk marks the pages reachable from the root.
+func (b *backup) walk(ptr uint64) error {
+	if ptr == 0 {
+		return nil
+	}
+	var node bptree.Node
+	page := pageOf(b.db, ptr)
+	err := b.locked(func() {
+		node = bptree.Node(bytes.Clone(b.db.tree.Get(ptr)))
+		b.gens[page] = b.db.gens.pages[page]
+	})
+	if err != nil {
+		return err
+	}
+	sectors := b.used[page]
+	if b.db.Compress {
+		for i := 0; i < extentSize(ptr); i++ {
+			sectors[extentSector(ptr)%PAGE_SECTORS+uint64(i)] = true
+		}
+	} else {
+		sectors = [PAGE_SECTORS]bool{true, true, true, true, true, true, true, true}
+	}
+	b.used[page] = sectors
+
+	if node.Type() == bptree.BNODE_INTERNAL {
+		for i := uint16(0); i < node.NumKeys(); i++ {
+			if err := b.walk(node.Ptr(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// layout places freelist nodes of the backup in free pages, and returns its meta page.
+func (b *backup) layout(root uint64, nFlushed uint64) []byte {
+	unit := uint64(1)
+	if b.db.Compress {
+		unit = PAGE_SECTORS
+	}
+	b.nPage = (nFlushed + unit - 1) / unit
+	for {
+		meta, ok := b.freeLists(root)
+		if ok {
+			return meta
+		}
+		// freelist nodes cannot be placed exactly, a free page is added
+		b.nPage++
+	}
+}
+
+// freeLists builds the freelists of the backup, and returns its meta page. It fails if the nodes do not use exactly
+// the free pages reserved for them.
+func (b *backup) freeLists(root uint64) ([]byte, bool) {
+	meta := &DB{Compress: b.db.Compress}
+	meta.tree.IntKeys = b.db.tree.IntKeys
+	meta.gens.commit = b.commit
+	meta.tree.Root = root
+	meta.page.nFlushed = b.nPage
+
+	// free pages, and free extents by amount of sectors
+	pages, extents := []uint64{}, [PAGE_SECTORS - 1][]uint64{}
+	for page := uint64(1); page < b.nPage; page++ {
+		sectors, ok := b.used[page]
+		if !ok {
+			pages = append(pages, page)
+			continue
+		}
+		for begin := 0; begin < PAGE_SECTORS; {
+			end := begin
+			for end < PAGE_SECTORS && !sectors[end] {
+				end++
+			}
+			if end > begin {
+				extents[end-begin-1] = append(extents[end-begin-1], extentPtr(page*PAGE_SECTORS+uint64(begin), end-begin))
+			}
+			begin = end + 1
+		}
+	}
+	ptr := func(page uint64) uint64 { return page }
+	if b.db.Compress {
+		meta.page.nFlushed *= PAGE_SECTORS
+		ptr = func(page uint64) uint64 { return extentPtr(page*PAGE_SECTORS, PAGE_SECTORS) }
+	}
+
+	// nodes of the extent freelists come first, then nodes of the page freelist
+	nNode := 0
+	for _, items := range extents {
+		nNode += (len(items) + FLNODE_CAP - 1) / FLNODE_CAP
+	}
+	if nNode > len(pages) {
+		return nil, false
+	}
+	nPageNode, ok := compactFreeListNodes(len(pages) - nNode)
+	if !ok || nNode+nPageNode > len(pages) {
+		return nil, false
+	}
+	nodes := pages[:nNode+nPageNode]
+	b.fl = map[uint64]bptree.Node{}
+	fl := FreeList{new: func(node bptree.Node) uint64 {
+		page := nodes[0]
+		nodes = nodes[1:]
+		b.fl[page] = node
+		return ptr(page)
+	}}
+	for i, items := range extents {
+		fl.head = 0
+		flPush(&fl, items, nil, 0)
+		meta.extent.fl[i].head = fl.head
+	}
+	items := []uint64{}
+	for _, page := range pages[nNode+nPageNode:] {
+		items = append(items, ptr(page))
+	}
+	fl.head = 0
+	flPush(&fl, items, nil, 0)
+	meta.fl.head = fl.head
+
+	page := make([]byte, bptree.PAGE_SIZE)
+	copy(page, metaPageEncode(meta))
+	return page, true
+}
+
+// page returns a page of the backup.
+func (b *backup) page(page uint64) ([]byte, error) {
+	if node, ok := b.fl[page]; ok {
+		return node, nil
+	}
+	sectors, ok := b.used[page]
+	if !ok {
+		return make([]byte, bptree.PAGE_SIZE), nil
+	}
+
+	data := []byte(nil)
+	err := b.locked(func() {
+		if b.db.Compress {
+			data = bytes.Clone(pageGetMapped(b.db, page))
+		} else {
+			data = bytes.Clone(b.db.pageGet(page))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != bptree.PAGE_SIZE {
+		return nil, fmt.Errorf("Backup: page %d is not mapped", page)
+	}
+	// free sectors are zeroed
+	for i, used := range sectors {
+		if !used {
+			clear(data[i*SECTOR_SIZE : (i+1)*SECTOR_SIZE])
+		}
+	}
+	return data, nil
+}
+
+// backupBusy returns an error if a backup is pinned, for operations moving pages of the pinned root.
+func backupBusy(db *DB, op string) error {
+	if db.backup.pins > 0 {
+		return fmt.Errorf("%s: %w", op, ErrBackupPinned)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+
+Integrity check
+
+Check walks the B+ tree from the root and every freelist from its head, marking the pages, or sectors with
+compression, referenced by them. A unit marked twice is referenced twice, and a unit never marked is leaked, being
+neither reachable nor free. Nodes are validated when they are read, and keys of a node must lie in the range given by
+its parent: the first key equals the key of the parent, and the last key is less than the next key of the parent.
+
+*/
+
+// CheckReport is the result of Check.
+type CheckReport struct {
+	Pages     uint64 // flushed pages including the meta page
+	Height    int    // height of the tree, 0 if empty
+	Nodes     int    // reachable B+ tree nodes
+	Keys      int    // keys in leaves, not counting the dummy key
+	FreeNodes int    // freelist nodes
+	Free      int    // free pages, or extents with compression
+	Problems  []*ErrCorruptPage
+}
+
+// OK reports whether no problem is found.
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *CheckReport) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "pages: %d\n", r.Pages)
+	fmt.Fprintf(&b, "tree: height %d, %d nodes, %d keys\n", r.Height, r.Nodes, r.Keys)
+	fmt.Fprintf(&b, "freelist: %d nodes, %d free\n", r.FreeNodes, r.Free)
+	fmt.Fprintf(&b, "problems: %d\n", len(r.Problems))
+	for _, p := range r.Problems {
+		fmt.Fprintf(&b, "  %v\n", p)
+	}
+	return b.String()
+}
+
+// checker holds the state of Check.
+type checker struct {
+	db     *DB
+	report *CheckReport
+	seen   []bool // referenced pages, or sectors with compression
+}
+
+// Check verifies the structure of the whole file, and reports problems found. An error is only returned if the
+// check cannot be done.
+func (db *DB) Check() (*CheckReport, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.page.updates) > 0 {
+		return nil, errors.New("Check: pending updates")
+	}
+	c := checker{db: db, report: &CheckReport{}, seen: make([]bool, db.page.nFlushed)}
+	c.report.Pages = db.page.nFlushed
+	if db.Compress {
+		c.report.Pages /= PAGE_SECTORS
+	}
+
+	if db.tree.Root != 0 {
+		c.tree(db.tree.Root, 1, nil, nil, nil)
+		c.report.Keys-- // the dummy key
+	}
+	c.freeList(&db.fl, PAGE_SECTORS)
+	// pages kept aside by backups are free as well
+	for _, ptr := range db.backup.freed {
+		c.ref(ptr)
+	}
+	c.report.Free += len(db.backup.freed)
+	for i := range db.extent.fl {
+		c.freeList(&db.extent.fl[i], i+1)
+	}
+	c.leaks()
+	return c.report, nil
+}
+
+func (c *checker) problem(ptr uint64, format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, &ErrCorruptPage{Page: pageOf(c.db, ptr), Reason: fmt.Sprintf(format, args...)})
+}
+
+// ref marks the units of a pointer, and reports whether it is the first reference to them.
+func (c *checker) ref(ptr uint64) bool {
+	if !ptrFlushed(c.db, ptr, c.db.page.nFlushed) {
+		c.problem(ptr, "pointer %d out of range", ptr)
+		return false
+	}
+	begin, end := ptr, ptr+1
+	if c.db.Compress {
+		begin = extentSector(ptr)
+		end = begin + uint64(extentSize(ptr))
+	}
+	first := true
+	for i := begin; i < end; i++ {
+		first = first && !c.seen[i]
+		c.seen[i] = true
+	}
+	if !first {
+		c.problem(ptr, "pointer %d referenced twice", ptr)
+	}
+	return first
+}
+
+// get reads a node with a callback, and reports a damaged node instead of panicking.
+func (c *checker) get(get func(uint64) bptree.Node, ptr uint64) (node bptree.Node) {
+	defer func() {
+		if r := recover(); r != nil {
+			corrupt, ok := r.(*ErrCorruptPage)
+			if !ok {
+				panic(r)
+			}
+			c.report.Problems = append(c.report.Problems, corrupt)
+			node = nil
+		}
+	}()
+	return get(ptr)
+}
+
+// tree checks a subtree, given the key of the parent, the next key of the parent, and the parent node.
+func (c *checker) tree(ptr uint64, depth int, first []byte, next []byte, parent bptree.Node) {
+	if !c.ref(ptr) {
+		return
+	}
+	node := c.get(c.db.tree.Get, ptr)
+	if node == nil {
+		return
+	}
+	c.report.Nodes++
+
+	if parent != nil && node.Layout() != parent.Layout() {
+		c.problem(ptr, "layout %#x differs from the parent", node.Layout())
+	}
+	n := node.NumKeys()
+	if first != nil && !bytes.Equal(node.Key(0), first) {
+		c.problem(ptr, "first key %q differs from the parent", node.Key(0))
+	}
+	if next != nil && bytes.Compare(node.Key(n-1), next) >= 0 {
+		c.problem(ptr, "key %q is not less than the next key of the parent", node.Key(n-1))
+	}
+
+	if node.Type() == bptree.BNODE_LEAF {
+		c.report.Keys += int(n)
+		if c.report.Height == 0 {
+			c.report.Height = depth
+		} else if depth != c.report.Height {
+			c.problem(ptr, "leaf at depth %d, expected %d", depth, c.report.Height)
+		}
+		return
+	}
+	for i := uint16(0); i < n; i++ {
+		kidNext := next
+		if i+1 < n {
+			kidNext = node.Key(i + 1)
+		}
+		c.tree(node.Ptr(i), depth+1, node.Key(i), kidNext, node)
+	}
+}
+
+// freeList checks a freelist whose items are extents of the given amount of sectors, or pages.
+func (c *checker) freeList(fl *FreeList, sectors int) {
+	for ptr, total := fl.head, -1; ptr != 0; {
+		if !c.ref(ptr) {
+			return
+		}
+		node := c.get(fl.get, ptr)
+		if node == nil {
+			return
+		}
+		c.report.FreeNodes++
+
+		size := flnSize(node)
+		if nodeTotal := int(flnNumNodes(node)); total >= 0 && nodeTotal != total {
+			c.problem(ptr, "freelist total %d, expected %d", nodeTotal, total)
+		}
+		total = int(flnNumNodes(node)) - size
+		for i := 0; i < size; i++ {
+			item := flnPtr(node, i)
+			if c.db.Compress && extentSize(item) != sectors {
+				c.problem(ptr, "free extent %d has %d sectors, expected %d", item, extentSize(item), sectors)
+			}
+			c.ref(item)
+		}
+		c.report.Free += size
+		ptr = flnNext(node)
+	}
+}
+
+// leaks reports units neither reachable nor free.
+func (c *checker) leaks() {
+	unit := uint64(1)
+	if c.db.Compress {
+		unit = PAGE_SECTORS
+	}
+	for page := uint64(1); page < c.db.page.nFlushed/unit; page++ {
+		leaked := 0
+		for _, seen := range c.seen[page*unit:][:unit] {
+			if !seen {
+				leaked++
+			}
+		}
+		if leaked == 0 {
+			continue
+		}
+		reason := "page leaked"
+		if c.db.Compress {
+			reason = fmt.Sprintf("%d sectors leaked", leaked)
+		}
+		c.report.Problems = append(c.report.Problems, &ErrCorruptPage{Page: page, Reason: reason})
+	}
+}
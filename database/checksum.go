@@ -0,0 +1,163 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"syscall"
+)
+
+/*
+
+Page checksums
+
+Every page but the meta page has a CRC32C checksum, stored in a sidecar file next to the database file:
+Path+CRC_SUFFIX: checksum of page 0(4B) - checksum of page 1(4B) - ...
+
+The sidecar is synced together with the written pages before the meta page is updated. Without DB.Compress, pages
+referenced by the current meta page are never overwritten, so a crash before the meta page is updated only leaves
+checksums of free pages out of date. With DB.Compress, new extents are written into the free sectors of pages holding
+live extents, so the page and its checksum change in place, and a crash may leave either of them written without the
+other. Such pages are tagged with the generation of the commit, and the tags synced, before they are written, see
+writePages. When the file is opened, pages tagged with a generation above the commit of the meta page are written by a
+commit not committed, and their checksums are computed again from the pages on disk: their live extents are unchanged,
+and their free sectors are not read.
+
+Checksums are verified on the first read of every page, and a mismatch raises ErrCorruptPage. With DB.NoChecksum,
+checksums are neither maintained nor verified, and the meta page records the sidecar as stale, so it is rebuilt when
+checksums are enabled again.
+
+*/
+
+const CRC_SUFFIX = ".crc"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptPage reports a page found damaged when it is read.
+type ErrCorruptPage struct {
+	Page   uint64
+	Reason string
+}
+
+func (e *ErrCorruptPage) Error() string {
+	return fmt.Sprintf("corrupt page %d: %s", e.Page, e.Reason)
+}
+
+// checksumInit opens the sidecar file and loads checksums of pages, or rebuilds them if they are stale.
+func checksumInit(db *DB) error {
+	if db.NoChecksum {
+		// the meta page records the sidecar as stale on the next commit
+		db.crc.stored = false
+		return nil
+	}
+	if db.ReadOnly && !db.crc.stored {
+		return nil
+	}
+
+	fp, err := sidecarOpen(db, CRC_SUFFIX)
+	if err != nil {
+		return fmt.Errorf("checksumInit: %w", err)
+	}
+	db.crc.fp = fp
+
+	nPage := db.fsize / bptree.PAGE_SIZE
+	db.crc.sums = make([]uint32, nPage)
+	db.crc.verified = make([]bool, nPage)
+	data := make([]byte, 4*nPage)
+
+	if db.crc.stored {
+		// pages extended but never written have no checksums
+		if _, err := fp.ReadAt(data, 0); err != nil && err != io.EOF {
+			return fmt.Errorf("checksumInit: %w", err)
+		}
+		for i := range db.crc.sums {
+			db.crc.sums[i] = binary.LittleEndian.Uint32(data[4*i:])
+		}
+		return checksumRecover(db)
+	}
+
+	for i := 1; i < nPage; i++ {
+		db.crc.sums[i] = crc32.Checksum(pageRaw(db, uint64(i)), crcTable)
+		db.crc.verified[i] = true
+		binary.LittleEndian.PutUint32(data[4*i:], db.crc.sums[i])
+	}
+	if _, err := syscall.Pwrite(int(fp.Fd()), data, 0); err != nil {
+		return fmt.Errorf("checksumInit: %w", err)
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("checksumInit: %w", err)
+	}
+	db.crc.stored = true
+	return nil
+}
+
+// checksumRecover computes again the checksums of pages written by a commit not committed, which may be out of date.
+func checksumRecover(db *DB) error {
+	data := [4]byte{}
+	recovered := false
+	for i := 1; i < len(db.crc.sums) && i < len(db.gens.pages); i++ {
+		if db.gens.pages[i] <= db.gens.commit {
+			continue
+		}
+		db.crc.sums[i] = crc32.Checksum(pageRaw(db, uint64(i)), crcTable)
+		db.crc.verified[i] = true
+		if db.ReadOnly {
+			continue
+		}
+		binary.LittleEndian.PutUint32(data[:], db.crc.sums[i])
+		if _, err := syscall.Pwrite(int(db.crc.fp.Fd()), data[:], int64(4*i)); err != nil {
+			return fmt.Errorf("checksumRecover: %w", err)
+		}
+		recovered = true
+	}
+	if recovered {
+		if err := db.crc.fp.Sync(); err != nil {
+			return fmt.Errorf("checksumRecover: %w", err)
+		}
+	}
+	return nil
+}
+
+// checksumVerify verifies the checksum of a page on its first read, and panics with ErrCorruptPage on mismatch.
+func checksumVerify(db *DB, ptr uint64, page []byte) {
+	if db.crc.fp == nil || ptr == 0 || ptr >= uint64(len(db.crc.sums)) || db.crc.verified[ptr] {
+		return
+	}
+	if crc32.Checksum(page, crcTable) != db.crc.sums[ptr] {
+		panic(&ErrCorruptPage{Page: ptr, Reason: "checksum mismatch"})
+	}
+	db.crc.verified[ptr] = true
+}
+
+// checksumUpdate updates checksums of the pages written by writePages.
+func checksumUpdate(db *DB) error {
+	if db.crc.fp == nil {
+		return nil
+	}
+
+	if n := db.fsize/bptree.PAGE_SIZE - len(db.crc.sums); n > 0 {
+		db.crc.sums = append(db.crc.sums, make([]uint32, n)...)
+		db.crc.verified = append(db.crc.verified, make([]bool, n)...)
+	}
+
+	data := [4]byte{}
+	for ptr := range pagesWritten(db) {
+		db.crc.sums[ptr] = crc32.Checksum(ringOverlay(db, ptr, pageRaw(db, ptr)), crcTable)
+		db.crc.verified[ptr] = true
+		binary.LittleEndian.PutUint32(data[:], db.crc.sums[ptr])
+		if _, err := syscall.Pwrite(int(db.crc.fp.Fd()), data[:], int64(4*ptr)); err != nil {
+			return fmt.Errorf("checksumUpdate: %w", err)
+		}
+	}
+	return nil
+}
+
+// checksumSync syncs the sidecar file.
+func checksumSync(db *DB) error {
+	if db.crc.fp == nil {
+		return nil
+	}
+	return fileSync(db, db.crc.fp)
+}
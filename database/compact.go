@@ -0,0 +1,273 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+)
+
+/*
+
+Compaction
+
+Compact shrinks the file in a single commit. It picks a limit, and relocates the tree nodes at or above the limit,
+along with their ancestors, into pages below the limit which are free in the committed meta page. The freelist is
+rebuilt with the rest of the pages below the limit, and the file is truncated at the limit after the commit.
+
+Pages referenced by the committed meta page are never overwritten, including the nodes of the old freelist, so the
+limit is the lowest one leaving enough free pages below it for the relocated nodes and the new freelist nodes.
+
+Compressed files are not compacted in place, since their extents share pages, and fail with ErrCompressed. Vacuum
+rewrites any file into a new one.
+
+*/
+
+// Compact relocates live pages toward the front of the file and truncates its tail, and returns the amount of bytes
+// reclaimed.
+func (db *DB) Compact() (reclaimed int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.Compress {
+		return 0, fmt.Errorf("Compact: %w, use Vacuum", ErrCompressed)
+	}
+	if err := readOnly(db, "Compact"); err != nil {
+		return 0, err
+	}
+	if err := backupBusy(db, "Compact"); err != nil {
+		return 0, err
+	}
+	// pages kept aside by backups are free as any other page not referenced
+	kept := db.backup.freed
+	db.backup.freed = nil
+
+	meta := metaPageEncode(db)
+	defer func() {
+		if err != nil {
+			pageDiscard(db)
+			_ = metaPageDecode(db, meta)
+			db.backup.freed = kept
+		}
+	}()
+	defer recoverCorrupt(db, meta, &err)
+
+	// pointers of tree nodes, the highest pointer of their subtrees, and nodes of the old freelist
+	tree, highest, fl := []uint64{}, []uint64{}, []uint64{}
+	var walk func(ptr uint64) uint64
+	walk = func(ptr uint64) uint64 {
+		node := db.tree.Get(ptr)
+		high := ptr
+		if node.Type() == bptree.BNODE_INTERNAL {
+			for i := uint16(0); i < node.NumKeys(); i++ {
+				high = max(high, walk(node.Ptr(i)))
+			}
+		}
+		tree, highest = append(tree, ptr), append(highest, high)
+		return high
+	}
+	if db.tree.Root != 0 {
+		walk(db.tree.Root)
+	}
+	for ptr := db.fl.head; ptr != 0; ptr = flnNext(db.fl.get(ptr)) {
+		fl = append(fl, ptr)
+	}
+
+	limit := compactLimit(db.page.nFlushed, tree, highest, fl)
+	if limit == db.page.nFlushed {
+		// the file may still be extended beyond the flushed pages
+		return compactTruncate(db)
+	}
+
+	// pages below the limit not referenced by the committed meta page
+	used := map[uint64]bool{}
+	for _, ptr := range append(tree, fl...) {
+		used[ptr] = true
+	}
+	free := []uint64{}
+	for ptr := uint64(1); ptr < limit; ptr++ {
+		if !used[ptr] {
+			free = append(free, ptr)
+		}
+	}
+
+	// relocated nodes and then freelist nodes take free pages from the front
+	alloc := func(node bptree.Node) uint64 {
+		ptr := free[0]
+		free = free[1:]
+		pageStore(db, ptr, node, nil)
+		return ptr
+	}
+	db.tree.New, db.fl.new = alloc, alloc
+	defer func() {
+		db.tree.New, db.fl.new = db.pageNew, db.pageAppend
+	}()
+	db.tree.Relocate(func(ptr uint64) bool { return ptr >= limit })
+
+	// the freelist is rebuilt with pages below the limit
+	freed := []uint64{}
+	for _, ptr := range fl {
+		if ptr < limit {
+			freed = append(freed, ptr)
+		}
+	}
+	for ptr, page := range db.page.updates {
+		if page == nil {
+			if ptr < limit {
+				freed = append(freed, ptr)
+			}
+			delete(db.page.updates, ptr)
+		}
+	}
+	nNode, _ := compactFreeListNodes(len(free) + len(freed))
+	items := append(freed, free[nNode:]...)
+	free = free[:nNode]
+	db.fl.head = 0
+	flPush(&db.fl, items, nil, 0)
+
+	db.page.nFlushed = limit
+	if err := flushPages(db); err != nil {
+		return 0, err
+	}
+	return compactTruncate(db)
+}
+
+// compactLimit returns the lowest limit of a file with nFlushed pages, leaving enough free pages below it for
+// relocated nodes and freelist nodes. Tree nodes are given with the highest pointers of their subtrees, and a node is
+// relocated if its subtree reaches the limit.
+func compactLimit(nFlushed uint64, tree []uint64, highest []uint64, fl []uint64) uint64 {
+	tree, highest, fl = sortedCopy(tree), sortedCopy(highest), sortedCopy(fl)
+	below := func(ptrs []uint64, limit uint64) int {
+		return sort.Search(len(ptrs), func(i int) bool { return ptrs[i] >= limit })
+	}
+
+	for limit := uint64(1 + len(tree)); limit < nFlushed; limit++ {
+		moved := len(highest) - below(highest, limit)
+		free := int(limit-1) - below(tree, limit) - below(fl, limit) - moved
+		// freed pages below the limit are the relocated nodes and the old freelist nodes there
+		freed := moved - (len(tree) - below(tree, limit)) + below(fl, limit)
+		if nNode, ok := compactFreeListNodes(free + freed); ok && free >= nNode {
+			return limit
+		}
+	}
+	return nFlushed
+}
+
+// compactFreeListNodes returns the amount of freelist nodes storing the given amount of pages, whose nodes are some
+// of the pages, and whether every node is used.
+func compactFreeListNodes(nPage int) (int, bool) {
+	nNode := (nPage + FLNODE_CAP) / (FLNODE_CAP + 1)
+	return nNode, (nPage-nNode+FLNODE_CAP-1)/FLNODE_CAP == nNode
+}
+
+func sortedCopy(ptrs []uint64) []uint64 {
+	sorted := append([]uint64{}, ptrs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// compactTruncate truncates the file and its sidecar files to the flushed pages, and returns the amount of bytes
+// reclaimed.
+func compactTruncate(db *DB) (int64, error) {
+	nPage := int(db.page.nFlushed)
+	fsize := nPage * bptree.PAGE_SIZE
+	reclaimed := int64(db.fsize - fsize)
+	if reclaimed <= 0 {
+		return 0, nil
+	}
+	if err := syscall.Ftruncate(int(db.fp.Fd()), int64(fsize)); err != nil {
+		return 0, fmt.Errorf("compactTruncate: %w", err)
+	}
+	db.fsize = fsize
+	poolTruncate(db, uint64(nPage))
+
+	sidecars := []struct {
+		fp   *os.File
+		size int
+	}{{db.crc.fp, 4 * nPage}, {db.enc.fp, GCM_ENTRY * nPage}, {db.gens.fp, 8 * nPage}}
+	for _, sidecar := range sidecars {
+		if sidecar.fp == nil {
+			continue
+		}
+		if err := sidecar.fp.Truncate(int64(sidecar.size)); err != nil {
+			return reclaimed, fmt.Errorf("compactTruncate: %w", err)
+		}
+	}
+	if len(db.crc.sums) > nPage {
+		db.crc.sums, db.crc.verified = db.crc.sums[:nPage], db.crc.verified[:nPage]
+	}
+	if len(db.gens.pages) > nPage {
+		db.gens.pages = db.gens.pages[:nPage]
+	}
+	if len(db.enc.entries) > GCM_ENTRY*nPage {
+		db.enc.entries = db.enc.entries[:GCM_ENTRY*nPage]
+	}
+	return reclaimed, nil
+}
+
+// VACUUM_BATCH is the amount of KVs copied by Vacuum in a commit.
+const VACUUM_BATCH = 1000
+
+// Vacuum copies every KV into an opened empty database, which is usually a new file. The new tree is built with
+// packed nodes, and its root is committed last, so the database stays empty until Vacuum succeeds.
+func (db *DB) Vacuum(dst *DB) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	if err := readOnly(dst, "Vacuum"); err != nil {
+		return err
+	}
+	if dst.tree.Root != 0 {
+		return errors.New("Vacuum: destination is not empty")
+	}
+	meta := metaPageEncode(dst)
+	defer func() {
+		if err != nil {
+			pageDiscard(dst)
+			_ = metaPageDecode(dst, meta)
+		}
+	}()
+	defer recoverCorrupt(db, metaPageEncode(db), &err)
+
+	b := dst.tree.NewBuilder()
+	n, dummy := 0, true
+	var walk func(ptr uint64) error
+	walk = func(ptr uint64) error {
+		node := db.tree.Get(ptr)
+		for i := uint16(0); i < node.NumKeys(); i++ {
+			if node.Type() == bptree.BNODE_INTERNAL {
+				if err := walk(node.Ptr(i)); err != nil {
+					return err
+				}
+				continue
+			}
+			if dummy {
+				dummy = false
+				continue // the first key of the leftmost leaf
+			}
+			if err := b.Add(node.Key(i), node.Val(i)); err != nil {
+				return fmt.Errorf("Vacuum: %w", err)
+			}
+			// nodes built are committed without the root
+			if n++; n%VACUUM_BATCH == 0 {
+				if err := flushPages(dst); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if db.tree.Root != 0 {
+		if err := walk(db.tree.Root); err != nil {
+			return err
+		}
+	}
+	b.Finish()
+	if err := flushPages(dst); err != nil {
+		return err
+	}
+	_, err = compactTruncate(dst)
+	return err
+}
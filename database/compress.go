@@ -0,0 +1,212 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+
+Page compression
+
+With DB.Compress, pointers to pages become pointers to extents: an extent is a run of sectors within a single page, and
+its pointer stores the first sector and the amount of sectors:
+EXTENT POINTER: first sector(61b) - amount of sectors - 1(3b)
+
+B+ tree nodes are compressed into the smallest extent holding them, which is taken from the smallest freed extents
+able to hold it, or appended to the file. Nodes that do not compress, as well as freelist
+nodes, are stored raw in extents of a whole page. A compressed extent starts with a header:
+EXTENT_MAGIC(2B) - payload length(2B) - payload
+The magic is never a valid node type, which tells compressed extents from raw pages.
+
+Freed extents are kept in freelists by their amount of sectors, DB.fl keeps extents of whole pages, including the
+nodes of the other freelists.
+The B+ tree and the freelists only see uncompressed nodes through the pageGet callback.
+
+*/
+
+// ErrCompressed is returned by operations rewriting pages in place, since extents of compressed files share pages.
+var ErrCompressed = errors.New("not supported for compressed files")
+
+const (
+	SECTOR_SIZE   = 512
+	PAGE_SECTORS  = bptree.PAGE_SIZE / SECTOR_SIZE
+	EXTENT_HEADER = 4
+	EXTENT_MAGIC  = 0x5A4C
+)
+
+func extentPtr(sector uint64, nSector int) uint64 {
+	return sector<<3 | uint64(nSector-1)
+}
+
+func extentSector(ptr uint64) uint64 {
+	return ptr >> 3
+}
+
+func extentSize(ptr uint64) int {
+	return int(ptr&7) + 1
+}
+
+// codec compresses nodes with DEFLATE, reusing its buffers between calls.
+type codec struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+	r   io.ReadCloser
+}
+
+// compress returns a compressed extent holding the node, including its header.
+func (c *codec) compress(node bptree.Node) []byte {
+	c.buf.Reset()
+	c.buf.Write(make([]byte, EXTENT_HEADER))
+	if c.w == nil {
+		c.w, _ = flate.NewWriter(&c.buf, flate.BestSpeed)
+	} else {
+		c.w.Reset(&c.buf)
+	}
+	_, _ = c.w.Write(node[:bptree.PAGE_SIZE])
+	_ = c.w.Close()
+
+	data := bytes.Clone(c.buf.Bytes())
+	binary.LittleEndian.PutUint16(data[0:], EXTENT_MAGIC)
+	binary.LittleEndian.PutUint16(data[2:], uint16(len(data)-EXTENT_HEADER))
+	return data
+}
+
+// decompress returns the node stored in an extent, which is either compressed or a raw page.
+func (c *codec) decompress(extent []byte) (bptree.Node, error) {
+	if binary.LittleEndian.Uint16(extent) != EXTENT_MAGIC {
+		if len(extent) < bptree.PAGE_SIZE {
+			return nil, errors.New("decompress: raw extent is smaller than a page")
+		}
+		return extent[:bptree.PAGE_SIZE], nil
+	}
+
+	size := int(binary.LittleEndian.Uint16(extent[2:]))
+	if EXTENT_HEADER+size > len(extent) {
+		return nil, errors.New("decompress: payload exceeds extent")
+	}
+	payload := bytes.NewReader(extent[EXTENT_HEADER : EXTENT_HEADER+size])
+	if c.r == nil {
+		c.r = flate.NewReader(payload)
+	} else if err := c.r.(flate.Resetter).Reset(payload, nil); err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+
+	node := make(bptree.Node, bptree.PAGE_SIZE)
+	if _, err := io.ReadFull(c.r, node); err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	return node, nil
+}
+
+// extentFreeList returns the freelist of extents with the amount of sectors, and the number of extents taken from it.
+func extentFreeList(db *DB, nSector int) (*FreeList, *int) {
+	if nSector == PAGE_SECTORS {
+		return &db.fl, &db.page.nFree
+	}
+	return &db.extent.fl[nSector-1], &db.extent.nFree[nSector-1]
+}
+
+// extentNew compresses a node and allocates an extent for it.
+func extentNew(db *DB, node bptree.Node) uint64 {
+	data := db.extent.codec.compress(node)
+	nSector := (len(data) + SECTOR_SIZE - 1) / SECTOR_SIZE
+	if nSector >= PAGE_SECTORS {
+		// nodes that do not compress are stored raw
+		data, nSector = node[:bptree.PAGE_SIZE], PAGE_SECTORS
+	}
+
+	ptr := extentAlloc(db, nSector)
+	pageStore(db, ptr, node, data)
+	return ptr
+}
+
+// extentPageNew allocates a whole page extent for a raw node. It serves as the callback of the extent freelists.
+func (db *DB) extentPageNew(node bptree.Node) uint64 {
+	ptr := extentAlloc(db, PAGE_SECTORS)
+	pageStore(db, ptr, node, node)
+	return ptr
+}
+
+// extentAlloc allocates an extent with at least the amount of sectors, reusing the smallest freed extents first.
+func extentAlloc(db *DB, nSector int) uint64 {
+	// whole pages are kept for nodes needing them
+	maxSector := PAGE_SECTORS - 1
+	if nSector == PAGE_SECTORS {
+		maxSector = PAGE_SECTORS
+	}
+	for n := nSector; n <= maxSector; n++ {
+		fl, nFree := extentFreeList(db, n)
+		if *nFree < fl.NumPage() {
+			ptr := fl.Get(*nFree)
+			*nFree++
+			return ptr
+		}
+	}
+	return extentAppend(db, nSector)
+}
+
+// extentAppend allocates an extent at the end of the file.
+func extentAppend(db *DB, nSector int) uint64 {
+	extentAlign(db, nSector)
+	sector := db.page.nFlushed + db.page.nAppend
+	db.page.nAppend += uint64(nSector)
+	return extentPtr(sector, nSector)
+}
+
+// extentAlign skips the rest of the last page if it cannot hold the amount of sectors, since extents never cross
+// pages. The skipped sectors are freed as an extent in the next writePages.
+func extentAlign(db *DB, nSector int) {
+	sector := db.page.nFlushed + db.page.nAppend
+	room := PAGE_SECTORS - int(sector%PAGE_SECTORS)
+	if room < nSector {
+		db.extent.pad = append(db.extent.pad, extentPtr(sector, room))
+		db.page.nAppend += uint64(room)
+	}
+}
+
+// extentFreeListUpdate updates every extent freelist with the freed extents of its size.
+// Freelist nodes are whole pages, so nodes popped from the other freelists are freed to DB.fl, which is updated last
+// since the other freelists allocate their nodes from it.
+func extentFreeListUpdate(db *DB, freed []uint64) {
+	bySize := [PAGE_SECTORS][]uint64{}
+	for _, ptr := range freed {
+		bySize[extentSize(ptr)-1] = append(bySize[extentSize(ptr)-1], ptr)
+	}
+	for i := range db.extent.fl {
+		fl := &db.extent.fl[i]
+		if db.extent.nFree[i] == 0 && len(bySize[i]) == 0 {
+			continue
+		}
+		// extents smaller than a page cannot hold freelist nodes, so there is nothing to reuse
+		nodes, remain, nPage := flPop(fl, db.extent.nFree[i])
+		flPush(fl, append(bySize[i], remain...), nil, nPage)
+		bySize[PAGE_SECTORS-1] = append(bySize[PAGE_SECTORS-1], nodes...)
+	}
+	db.fl.Update(db.page.nFree, bySize[PAGE_SECTORS-1])
+
+	// extents taken are popped
+	db.extent.nFree = [PAGE_SECTORS - 1]int{}
+	db.page.nFree = 0
+}
+
+// extentGetMapped returns the node stored in a flushed extent.
+// It panics with ErrCorruptPage if the extent cannot be decompressed.
+func extentGetMapped(db *DB, ptr uint64) bptree.Node {
+	page := extentSector(ptr) / PAGE_SECTORS
+	data := pageGetMapped(db, page)
+	if data == nil {
+		return nil
+	}
+	begin := extentSector(ptr) % PAGE_SECTORS * SECTOR_SIZE
+	node, err := db.extent.codec.decompress(data[begin : begin+uint64(extentSize(ptr))*SECTOR_SIZE])
+	if err != nil {
+		panic(&ErrCorruptPage{Page: page, Reason: err.Error()})
+	}
+	return node
+}
@@ -0,0 +1,2060 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type D struct {
+	t   *testing.T
+	db  *DB
+	ref map[string]string
+}
+
+func newD(t *testing.T, db *DB) *D {
+	db.Path = filepath.Join(t.TempDir(), "test.db")
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return &D{t: t, db: db, ref: map[string]string{}}
+}
+
+func (d *D) add(key string, val string) {
+	if err := d.db.Set([]byte(key), []byte(val)); err != nil {
+		d.t.Fatal(err)
+	}
+	d.ref[key] = val
+}
+
+func (d *D) del(key string) bool {
+	delete(d.ref, key)
+	ok, err := d.db.Del([]byte(key))
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	return ok
+}
+
+func (d *D) reopen() {
+	if err := d.db.Close(); err != nil {
+		d.t.Fatal(err)
+	}
+	*d.db = DB{Path: d.db.Path, Compress: d.db.Compress, IntKeys: d.db.IntKeys, NoChecksum: d.db.NoChecksum,
+		FillFactor: d.db.FillFactor, Key: d.db.Key, PlaintextBackup: d.db.PlaintextBackup, BufferPool: d.db.BufferPool,
+		DirectIO: d.db.DirectIO, Readahead: d.db.Readahead, NoRandomAdvice: d.db.NoRandomAdvice, IOUring: d.db.IOUring,
+		SpillPages: d.db.SpillPages, GroupCommitSize: d.db.GroupCommitSize, GroupCommitDelay: d.db.GroupCommitDelay,
+		Observer: d.db.Observer, Archive: d.db.Archive,
+		ArchiveSegmentSize: d.db.ArchiveSegmentSize}
+	if err := d.db.Open(); err != nil {
+		d.t.Fatal(err)
+	}
+}
+
+func (d *D) verify() {
+	for k, v := range d.ref {
+		val, ok, err := d.db.Get([]byte(k))
+		if err != nil {
+			d.t.Fatal(err)
+		}
+		if !ok || string(val) != v {
+			d.t.Fatalf("Failed, %s: %s is not equal to %s", k, v, val)
+		}
+	}
+}
+
+// check runs Check, and fails on problems or on a count of keys differing from the reference.
+func (d *D) check() {
+	report, err := d.db.Check()
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	if !report.OK() || report.Keys != len(d.ref) {
+		d.t.Fatalf("unexpected report:\n%v", report)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func testDB(t *testing.T, db *DB) *D {
+	d := newD(t, db)
+	for i := 0; i < 2000; i++ {
+		d.add(fmt.Sprintf("key%05d", i*7919%2000), strings.Repeat(fmt.Sprintf("val%d ", i), 20))
+	}
+	for i := 0; i < 2000; i += 3 {
+		if !d.del(fmt.Sprintf("key%05d", i)) {
+			t.Fatalf("key%05d not deleted", i)
+		}
+	}
+	for i := 0; i < 500; i++ {
+		d.add(fmt.Sprintf("key%05d", i), "updated")
+	}
+	d.verify()
+	d.reopen()
+	d.verify()
+	return d
+}
+
+func TestDB(t *testing.T) {
+	testDB(t, &DB{})
+}
+
+func TestDB_Compress(t *testing.T) {
+	d := testDB(t, &DB{Compress: true})
+	if !d.db.Compress {
+		t.Errorf("compression not restored from meta page")
+	}
+
+	plain := testDB(t, &DB{})
+	if fileSize(t, d.db.Path) >= fileSize(t, plain.db.Path) {
+		t.Errorf("compressed file is not smaller: %d >= %d", fileSize(t, d.db.Path), fileSize(t, plain.db.Path))
+	}
+}
+
+func TestDB_CommitFailure(t *testing.T) {
+	for _, db := range []*DB{{}, {Compress: true}, {Key: []byte("0123456789abcdef")}} {
+		d := testDB(t, db)
+
+		// commits fail while the file is written through a read-only handle
+		fp := d.db.fp
+		ro, err := os.Open(d.db.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.db.fp = ro
+		if err := d.db.Set([]byte("failed"), []byte(strings.Repeat("val ", 100))); err == nil {
+			t.Fatal("a write into a read-only handle succeeded")
+		}
+		if _, err := d.db.Del([]byte("key00001")); err == nil {
+			t.Fatal("a write into a read-only handle succeeded")
+		}
+		d.db.fp = fp
+		_ = ro.Close()
+
+		// failed commits are rolled back, and are not committed by the next commit
+		if _, ok, err := d.db.Get([]byte("failed")); ok || err != nil {
+			t.Fatalf("the key of a failed commit is found %v", err)
+		}
+		d.add("next", "val")
+		d.verify()
+		d.reopen()
+		d.verify()
+		if _, ok, err := d.db.Get([]byte("failed")); ok || err != nil {
+			t.Fatalf("the key of a failed commit is committed %v", err)
+		}
+		// pages allocated by failed commits are not leaked
+		d.check()
+	}
+}
+
+func TestDB_GetCopy(t *testing.T) {
+	for _, db := range []*DB{{}, {Compress: true}, {IntKeys: true}, {BufferPool: 4}} {
+		d := testDB(t, db)
+		got, want := map[string][]byte{}, map[string]string{}
+		for i := 1; i < 2000; i += 7 {
+			key := fmt.Sprintf("key%05d", i)
+			val, ok, err := d.db.Get([]byte(key))
+			if _, found := d.ref[key]; err != nil || ok != found {
+				t.Fatalf("Get(%s) = %v, %v", key, ok, err)
+			}
+			got[key], want[key] = val, d.ref[key]
+		}
+
+		// values returned stay the same while pages are freed, relocated and reused
+		for i := 0; i < 2000; i += 2 {
+			d.add(fmt.Sprintf("key%05d", i), strings.Repeat("overwritten ", 10))
+		}
+		if !db.Compress {
+			if _, err := d.db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 2000; i += 2 {
+			d.del(fmt.Sprintf("key%05d", i))
+		}
+		for key, val := range got {
+			if string(val) != want[key] {
+				t.Fatalf("value of %s changed from %q to %q", key, want[key], val)
+			}
+		}
+		d.reopen()
+		d.verify()
+	}
+}
+
+func TestDB_EmptyKey(t *testing.T) {
+	d := newD(t, &DB{})
+	d.add("key", "val")
+
+	// the empty key is the dummy key of the first leaf
+	if err := d.db.Set(nil, []byte("val")); !errors.Is(err, bptree.ErrBadKey) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, ok, err := d.db.Get(nil); ok || err != nil {
+		t.Fatalf("empty key found %v", err)
+	}
+	if ok, err := d.db.Del([]byte{}); ok || err != nil {
+		t.Fatalf("empty key deleted %v", err)
+	}
+
+	// the tree is still usable once every key is deleted
+	d.del("key")
+	d.reopen()
+	d.add("key", "new")
+	d.verify()
+}
+
+func TestDB_IntKeys(t *testing.T) {
+	for _, db := range []*DB{{IntKeys: true}, {IntKeys: true, Compress: true}} {
+		d := newD(t, db)
+		for i := uint64(1); i <= 2000; i++ {
+			d.add(string(bptree.U64Key(i*7919%2000+1)), fmt.Sprintf("val%d", i))
+		}
+		if err := d.db.Set([]byte("short"), []byte("val")); !errors.Is(err, bptree.ErrBadKey) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// the layout is recorded in the meta page, and not taken from the options of an existing file
+		d.db.IntKeys = false
+		d.reopen()
+		if !d.db.IntKeys {
+			t.Fatal("the layout is not recorded")
+		}
+		d.verify()
+		if err := d.db.Set([]byte("short"), []byte("val")); !errors.Is(err, bptree.ErrBadKey) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if _, ok, err := d.db.Get([]byte("short")); ok || err != nil {
+			t.Fatalf("short key found %v", err)
+		}
+		if ok, err := d.db.Del([]byte("short")); ok || err != nil {
+			t.Fatalf("short key deleted %v", err)
+		}
+		d.del(string(bptree.U64Key(1000)))
+		d.add(string(bptree.U64Key(5000)), "added")
+		d.reopen()
+		d.verify()
+		d.check()
+		if meta := d.db.InspectMeta(); meta.Flags&META_FLAG_INT_KEYS == 0 || !strings.Contains(meta.String(), "int keys") {
+			t.Fatalf("the layout is not inspected:\n%v", meta)
+		}
+	}
+
+	// a file created without the layout keeps variable keys
+	d := newD(t, &DB{})
+	d.add("key", "val")
+	d.db.IntKeys = true
+	d.reopen()
+	if d.db.IntKeys {
+		t.Fatal("the layout is taken from the options")
+	}
+	d.add("another key", "val")
+	d.verify()
+
+	// a group commit rejects the key of its write only
+	d = newD(t, &DB{IntKeys: true, GroupCommitSize: 4})
+	d.add(string(bptree.U64Key(1)), "val")
+	if err := d.db.Set([]byte("short"), []byte("val")); !errors.Is(err, bptree.ErrBadKey) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	d.add(string(bptree.U64Key(2)), "val")
+	d.verify()
+}
+
+func TestDB_ReadOnlyMmap(t *testing.T) {
+	d := testDB(t, &DB{})
+	scribble := func() (fault any) {
+		node := d.db.tree.Get(d.db.tree.Root)
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer func() { fault = recover() }()
+		node[0] ^= 0xff
+		return nil
+	}
+	if scribble() == nil {
+		t.Fatal("a write into a mapped node does not fault")
+	}
+	d.reopen()
+	d.verify()
+
+	// the mapping of a file grown by later writes is read-only too
+	for i := 0; i < 500; i++ {
+		d.add(fmt.Sprintf("grow%05d", i), strings.Repeat("v", 1000))
+	}
+	if scribble() == nil {
+		t.Fatal("a write into a node mapped after later writes does not fault")
+	}
+	d.verify()
+	d.reopen()
+	d.verify()
+}
+
+func testChecksum(t *testing.T, db *DB) {
+	d := testDB(t, db)
+	if err := d.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a bit in the page of the root
+	root := d.db.tree.Root
+	if d.db.Compress {
+		root = extentSector(root) / PAGE_SECTORS
+	}
+	fp, err := os.OpenFile(d.db.Path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := []byte{0}
+	off := int64(root)*4096 + 4095
+	_, _ = fp.ReadAt(b, off)
+	b[0] ^= 1
+	_, _ = fp.WriteAt(b, off)
+	_ = fp.Close()
+
+	*d.db = DB{Path: d.db.Path}
+	if err := d.db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = d.db.Get([]byte("key00001"))
+	corrupt := &ErrCorruptPage{}
+	if !errors.As(err, &corrupt) || corrupt.Page != root {
+		t.Fatalf("expected corrupt page %d, got %v", root, err)
+	}
+	if err := d.db.Set([]byte("key00001"), []byte("x")); !errors.As(err, &corrupt) {
+		t.Fatalf("expected corrupt page %d, got %v", root, err)
+	}
+
+	// checksums are not verified when disabled
+	d.reopen()
+	if err := d.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	*d.db = DB{Path: d.db.Path, NoChecksum: true}
+	if err := d.db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.db.Get([]byte("key00001")); err != nil {
+		t.Fatal(err)
+	}
+
+	// opening without checksums does not make the damage trusted
+	if err := d.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	*d.db = DB{Path: d.db.Path}
+	if err := d.db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.db.Get([]byte("key00001")); !errors.As(err, &corrupt) || corrupt.Page != root {
+		t.Fatalf("expected corrupt page %d, got %v", root, err)
+	}
+}
+
+func TestDB_Checksum(t *testing.T) {
+	testChecksum(t, &DB{})
+}
+
+func TestDB_ChecksumCompress(t *testing.T) {
+	testChecksum(t, &DB{Compress: true})
+}
+
+func TestDB_ChecksumRewrite(t *testing.T) {
+	// a crash before the meta page is updated loses either pages rewritten in place, or their checksums
+	for _, lost := range []string{"", CRC_SUFFIX} {
+		d := testDB(t, &DB{Compress: true})
+		path := d.db.Path
+		old, err := os.ReadFile(path + lost)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d.db.mu.Lock()
+		for i := 0; !pagesRewritten(d.db); i++ {
+			if i == 1000 {
+				t.Fatal("no page holding live extents is rewritten")
+			}
+			d.db.tree.Insert([]byte(fmt.Sprintf("new%05d", i)), []byte("new"))
+		}
+		if err := writePages(d.db); err != nil {
+			t.Fatal(err)
+		}
+		d.db.mu.Unlock()
+		if err := d.db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path+lost, old, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		*d.db = DB{Path: path}
+		if err := d.db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		d.verify()
+		if report, err := d.db.Check(); err != nil || !report.OK() {
+			t.Fatalf("lost %q: unexpected report %v:\n%v", lost, err, report)
+		}
+		d.add("key00000", "after")
+		d.reopen()
+		d.verify()
+	}
+}
+
+func TestDB_Lock(t *testing.T) {
+	d := newD(t, &DB{})
+	d.add("key", "val")
+
+	// a file opened for writing is not opened by another process
+	for _, readOnly := range []bool{false, true} {
+		other := &DB{Path: d.db.Path, ReadOnly: readOnly}
+		if err := other.Open(); !errors.Is(err, ErrLocked) {
+			t.Fatalf("read-only %v: expected ErrLocked, got %v", readOnly, err)
+		}
+	}
+	if err := d.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// readers share the file, and keep writers out
+	readers := []*DB{{Path: d.db.Path, ReadOnly: true}, {Path: d.db.Path, ReadOnly: true, DirectIO: true}}
+	for _, r := range readers {
+		if err := r.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if val, ok, err := r.Get([]byte("key")); err != nil || !ok || string(val) != "val" {
+			t.Fatalf("unexpected value %q %v", val, err)
+		}
+	}
+	*d.db = DB{Path: d.db.Path}
+	if err := d.db.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	for _, r := range readers {
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*d.db = DB{Path: d.db.Path}
+	if err := d.db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	d.verify()
+}
+
+func TestDB_ReadOnly(t *testing.T) {
+	for _, db := range []*DB{{}, {Key: []byte("0123456789abcdef")}, {Archive: true}} {
+		d := testDB(t, db)
+		if err := d.db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		paths, _ := filepath.Glob(d.db.Path + "*")
+		files := map[string]string{}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[path] = string(data)
+		}
+
+		for _, noChecksum := range []bool{false, true} {
+			*d.db = DB{Path: d.db.Path, Key: db.Key, Archive: db.Archive, ReadOnly: true, NoChecksum: noChecksum}
+			if err := d.db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			d.verify()
+			if err := d.db.Set([]byte("key00001"), []byte("x")); !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("expected ErrReadOnly, got %v", err)
+			}
+			if _, err := d.db.Del([]byte("key00001")); !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("expected ErrReadOnly, got %v", err)
+			}
+			if _, err := d.db.Compact(); !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("expected ErrReadOnly, got %v", err)
+			}
+			if _, err := d.db.Defragment(nil, nil); !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("expected ErrReadOnly, got %v", err)
+			}
+			// a file opened read-only is still vacuumed into another one
+			out := newD(t, &DB{})
+			if err := d.db.Vacuum(out.db); err != nil {
+				t.Fatal(err)
+			}
+			out.ref = d.ref
+			out.verify()
+			if report, _ := d.db.Check(); !report.OK() {
+				t.Fatalf("unexpected report:\n%v", report)
+			}
+			d.verify()
+			if err := d.db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// no file is changed
+		paths, _ = filepath.Glob(d.db.Path + "*")
+		if len(paths) != len(files) {
+			t.Fatalf("files %v, expected %d", paths, len(files))
+		}
+		for path, want := range files {
+			if data, _ := os.ReadFile(path); string(data) != want {
+				t.Fatalf("%s is changed", path)
+			}
+		}
+		*d.db = DB{Path: d.db.Path, Key: db.Key, Archive: db.Archive}
+		if err := d.db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		d.add("after", "read-only")
+		d.verify()
+	}
+
+	// a file opened read-only is never created
+	db := &DB{Path: filepath.Join(t.TempDir(), "missing.db"), ReadOnly: true}
+	if err := db.Open(); err == nil {
+		t.Fatalf("missing file opened")
+	}
+}
+
+func TestDB_Encrypt(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	d := testDB(t, &DB{Key: key})
+	d.add("secret", "plaintext-marker")
+	data, err := os.ReadFile(d.db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "plaintext-marker") {
+		t.Fatalf("value is stored in plaintext")
+	}
+
+	open := func(key []byte) error {
+		_ = d.db.Close()
+		*d.db = DB{Path: d.db.Path, Key: key}
+		return d.db.Open()
+	}
+	if err := open([]byte("fedcba9876543210fedcba9876543210")); err != ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+	if err := open(nil); err == nil {
+		t.Fatalf("encrypted file opened without a key")
+	}
+	if err := open(key); err != nil {
+		t.Fatal(err)
+	}
+	d.verify()
+
+	// rotate the key
+	newKey := []byte("fedcba9876543210")
+	if err := d.db.Rekey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	d.verify()
+	if err := open(key); err != ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+	if err := open(newKey); err != nil {
+		t.Fatal(err)
+	}
+	d.verify()
+	d.add("after", "rotation")
+
+	// decrypt
+	if err := d.db.Rekey(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := open(nil); err != nil {
+		t.Fatal(err)
+	}
+	d.verify()
+}
+
+func TestDB_CompressUnsupported(t *testing.T) {
+	d := testDB(t, &DB{Compress: true})
+	if _, err := d.db.Compact(); !errors.Is(err, ErrCompressed) {
+		t.Fatalf("Compact: unexpected error %v", err)
+	}
+	if _, err := d.db.Defragment(nil, nil); !errors.Is(err, ErrCompressed) {
+		t.Fatalf("Defragment: unexpected error %v", err)
+	}
+	if err := d.db.Rekey([]byte("0123456789abcdef")); !errors.Is(err, ErrCompressed) {
+		t.Fatalf("Rekey: unexpected error %v", err)
+	}
+	d.verify()
+
+	// a compressed file is not created encrypted
+	db := &DB{Path: filepath.Join(t.TempDir(), "test.db"), Compress: true, Key: []byte("0123456789abcdef")}
+	if err := db.Open(); !errors.Is(err, ErrCompressed) {
+		t.Fatalf("Open: unexpected error %v", err)
+	}
+
+	// Vacuum rewrites it instead
+	out := newD(t, &DB{Compress: true})
+	if err := d.db.Vacuum(out.db); err != nil {
+		t.Fatal(err)
+	}
+	out.ref = d.ref
+	out.verify()
+}
+
+func TestDB_CorruptNode(t *testing.T) {
+	d := testDB(t, &DB{NoChecksum: true})
+	if err := d.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a node with a damaged number of keys passes no checksum, but fails the validation
+	root := d.db.tree.Root
+	fp, err := os.OpenFile(d.db.Path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fp.WriteAt([]byte{0xff, 0xff}, int64(root)*4096+2)
+	_ = fp.Close()
+
+	*d.db = DB{Path: d.db.Path, NoChecksum: true}
+	if err := d.db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = d.db.Get([]byte("key00001"))
+	corrupt := &ErrCorruptPage{}
+	if !errors.As(err, &corrupt) || corrupt.Page != root {
+		t.Fatalf("expected corrupt page %d, got %v", root, err)
+	}
+}
+
+func FuzzMetaPageLoad(f *testing.F) {
+	for _, db := range []*DB{{}, {Compress: true}} {
+		db.tree.Root, db.page.nFlushed, db.fl.head = 3, 16, 5
+		db.crc.stored = true
+		f.Add(metaPageEncode(db))
+	}
+	f.Add([]byte(DB_SIG))
+	f.Add(make([]byte, META_SIZE))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		db := &DB{fsize: 16 * 4096}
+		db.mmap.chunks = [][]byte{data}
+		if metaPageLoad(db) != nil {
+			return
+		}
+		// pointers of a loaded meta page are in the file
+		if db.tree.Root != 0 && !ptrFlushed(db, db.tree.Root, db.page.nFlushed) {
+			t.Fatalf("root %d out of range", db.tree.Root)
+		}
+	})
+}
+
+func testCheck(t *testing.T, db *DB) *D {
+	d := testDB(t, db)
+	d.check()
+	report, err := d.db.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Free == 0 {
+		t.Fatalf("free pages are not reported:\n%v", report)
+	}
+
+	// free pages are leaked without the freelists
+	head := d.db.fl.head
+	d.db.fl.head = 0
+	if report, _ = d.db.Check(); report.OK() {
+		t.Fatalf("leaked pages are not reported:\n%v", report)
+	}
+	d.db.fl.head = head
+	return d
+}
+
+func TestDB_Check(t *testing.T) {
+	d := testCheck(t, &DB{})
+	if err := d.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the root references its first kid twice
+	root := d.db.tree.Root
+	fp, err := os.OpenFile(d.db.Path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid := make([]byte, 8)
+	_, _ = fp.ReadAt(kid, int64(root)*4096+4)
+	_, _ = fp.WriteAt(kid, int64(root)*4096+4+8)
+	_ = fp.Close()
+
+	*d.db = DB{Path: d.db.Path, NoChecksum: true}
+	if err := d.db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := d.db.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report.String(), "referenced twice") || !strings.Contains(report.String(), "leaked") {
+		t.Fatalf("double reference is not reported:\n%v", report)
+	}
+}
+
+func TestDB_CheckCompress(t *testing.T) {
+	testCheck(t, &DB{Compress: true})
+}
+
+func testSalvage(t *testing.T, db *DB) {
+	d := testDB(t, db)
+	for i := 1; i < 2000; i += 97 {
+		d.del(fmt.Sprintf("key%05d", i))
+	}
+	if err := d.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	salvage := func() (*D, *SalvageReport) {
+		out := newD(t, &DB{})
+		report, err := Salvage(d.db.Path, d.db.Key, out.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Keys < len(d.ref) {
+			t.Fatalf("keys are lost:\n%v", report)
+		}
+		out.ref = d.ref
+		return out, report
+	}
+
+	// keys deleted from the tree do not come back from old leaves
+	out, report := salvage()
+	out.verify()
+	if report.Keys != len(d.ref) || report.Deleted == 0 || report.Unreachable != 0 {
+		t.Fatalf("unexpected report:\n%v", report)
+	}
+	if check, err := out.db.Check(); err != nil || check.Keys != len(d.ref) {
+		t.Fatalf("unexpected report %v:\n%v", err, check)
+	}
+
+	// the root is damaged, and live leaves are told from old ones by the freelist
+	off, size := int64(d.db.tree.Root)*4096, 4096
+	if d.db.Compress {
+		off, size = int64(extentSector(d.db.tree.Root))*SECTOR_SIZE, extentSize(d.db.tree.Root)*SECTOR_SIZE
+	}
+	fp, err := os.OpenFile(d.db.Path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	_, _ = fp.WriteAt(make([]byte, size), off)
+	out, report = salvage()
+	out.verify()
+	if report.Unreachable != report.Keys || report.Deleted != 0 {
+		t.Fatalf("unexpected report:\n%v", report)
+	}
+
+	// the meta page is damaged as well, and old versions may come back
+	_, _ = fp.WriteAt(make([]byte, 4096), 0)
+	out, _ = salvage()
+	for k := range d.ref {
+		if _, ok, _ := out.db.Get([]byte(k)); !ok {
+			t.Fatalf("key %s is lost", k)
+		}
+	}
+}
+
+func TestSalvage(t *testing.T) {
+	testSalvage(t, &DB{})
+}
+
+func TestSalvage_Compress(t *testing.T) {
+	testSalvage(t, &DB{Compress: true})
+}
+
+func TestSalvage_Encrypt(t *testing.T) {
+	testSalvage(t, &DB{Key: []byte("0123456789abcdef")})
+}
+
+func TestSalvage_IntKeys(t *testing.T) {
+	d := newD(t, &DB{IntKeys: true})
+	for i := uint64(1); i <= 2000; i++ {
+		d.add(string(bptree.U64Key(i*7919%2000+1)), fmt.Sprintf("val%d", i))
+	}
+	for i := uint64(1); i <= 2000; i += 97 {
+		d.del(string(bptree.U64Key(i)))
+	}
+	if err := d.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the dummy key of the int layout is skipped, with or without the meta page
+	for _, damage := range []bool{false, true} {
+		if damage {
+			fp, err := os.OpenFile(d.db.Path, os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = fp.WriteAt(make([]byte, 4096), 0)
+			_ = fp.Close()
+		}
+		out := newD(t, &DB{IntKeys: true})
+		report, err := Salvage(d.db.Path, nil, out.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Keys < len(d.ref) || !damage && report.Keys != len(d.ref) {
+			t.Fatalf("unexpected report:\n%v", report)
+		}
+		out.ref = d.ref
+		out.verify()
+	}
+}
+
+func TestDB_Compact(t *testing.T) {
+	for _, db := range []*DB{{}, {Key: []byte("0123456789abcdef")}} {
+		d := testDB(t, db)
+		for i := 0; i < 2000; i++ {
+			if i%4 != 0 {
+				d.del(fmt.Sprintf("key%05d", i))
+			}
+		}
+		before := fileSize(t, d.db.Path)
+		reclaimed, err := d.db.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reclaimed <= 0 || fileSize(t, d.db.Path) != before-reclaimed {
+			t.Fatalf("%d bytes reclaimed from %d bytes, file size %d", reclaimed, before, fileSize(t, d.db.Path))
+		}
+		if report, _ := d.db.Check(); !report.OK() {
+			t.Fatalf("unexpected report:\n%v", report)
+		}
+		d.verify()
+
+		// the compacted file is still usable
+		for i := 0; i < 500; i++ {
+			d.add(fmt.Sprintf("key%05d", i), "again")
+		}
+		d.reopen()
+		d.verify()
+		if report, _ := d.db.Check(); !report.OK() {
+			t.Fatalf("unexpected report:\n%v", report)
+		}
+	}
+}
+
+func testDefragment(t *testing.T, db *DB) {
+	d := testDB(t, db)
+	// leaves of a range are in consecutive pages
+	sequential := func(start, end []byte) bool {
+		leaves, _ := defragNodes(d.db, start, end)
+		return len(leaves) > 1 && defragSequential(leaves)
+	}
+	defragment := func(start, end []byte) {
+		if sequential(start, end) {
+			t.Fatalf("leaves of [%q, %q) are already sequential", start, end)
+		}
+		n, err := d.db.Defragment(start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 || !sequential(start, end) {
+			t.Fatalf("leaves of [%q, %q) are not sequential after %d pages rewritten", start, end, n)
+		}
+		if n, err := d.db.Defragment(start, end); n != 0 || err != nil {
+			t.Fatalf("%d pages rewritten again, %v", n, err)
+		}
+		d.check()
+		d.verify()
+	}
+	defragment([]byte("key00500"), []byte("key01000"))
+	defragment(nil, nil)
+
+	// later writes fragment the leaves again, and the leaves defragmented stay sequential in the reopened file
+	for i := 0; i < 2000; i += 3 {
+		d.add(fmt.Sprintf("key%05d", i), strings.Repeat("later", i%20))
+	}
+	defragment(nil, nil)
+	d.add("after", "defragment")
+	d.reopen()
+	d.verify()
+	if !sequential([]byte("key00500"), []byte("key01000")) {
+		t.Fatal("leaves are not sequential after a reopen")
+	}
+	d.check()
+}
+
+func TestDB_Defragment(t *testing.T) {
+	testDefragment(t, &DB{})
+}
+
+func TestDB_DefragmentEncrypt(t *testing.T) {
+	testDefragment(t, &DB{Key: []byte("0123456789abcdef")})
+}
+
+func TestDB_DefragmentBufferPool(t *testing.T) {
+	testDefragment(t, &DB{BufferPool: 8})
+}
+
+func testSpill(t *testing.T, db *DB) {
+	db.SpillPages = 4
+	d := testDB(t, db)
+	// a commit inserting many keys reads spilled nodes back
+	spill(t, d, "spill")
+	d.verify()
+
+	// a commit rewriting every page
+	if db.Compress {
+		out := newD(t, &DB{Compress: true, SpillPages: 4})
+		if err := d.db.Vacuum(out.db); err != nil {
+			t.Fatal(err)
+		}
+		out.ref = d.ref
+		d = out
+	} else if err := d.db.Rekey([]byte("fedcba9876543210")); err != nil {
+		t.Fatal(err)
+	}
+	d.verify()
+	if s, _ := d.db.Stats(); s.Spilled == 0 {
+		t.Fatalf("no page spilled")
+	}
+	if size := fileSize(t, d.db.Path+SPILL_SUFFIX); size != 0 {
+		t.Fatalf("scratch file of %d bytes after the commit", size)
+	}
+	d.check()
+
+	d.reopen()
+	d.verify()
+	if _, err := os.Stat(d.db.Path + SPILL_SUFFIX); !os.IsNotExist(err) {
+		t.Fatalf("scratch file is not removed: %v", err)
+	}
+
+	// the reopened database spills later commits to a new scratch file
+	for i := 0; i < 1000; i += 3 {
+		d.del(fmt.Sprintf("spill%04d", i))
+	}
+	spill(t, d, "later")
+	if s, _ := d.db.Stats(); s.Spilled == 0 {
+		t.Fatalf("no page spilled after a reopen")
+	}
+	if size := fileSize(t, d.db.Path+SPILL_SUFFIX); size != 0 {
+		t.Fatalf("scratch file of %d bytes after the commit", size)
+	}
+	d.verify()
+	d.reopen()
+	d.verify()
+	d.check()
+}
+
+// spill inserts 1000 keys with the prefix in a single commit.
+func spill(t *testing.T, d *D, prefix string) {
+	d.db.mu.Lock()
+	defer d.db.mu.Unlock()
+	for i := 0; i < 1000; i++ {
+		key, val := fmt.Sprintf("%s%04d", prefix, i*7919%1000), fmt.Sprintf("val%d", i)
+		d.db.tree.Insert([]byte(key), []byte(val))
+		d.ref[key] = val
+	}
+	if err := flushPages(d.db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDB_Spill(t *testing.T) {
+	testSpill(t, &DB{})
+}
+
+func TestDB_SpillEncrypt(t *testing.T) {
+	testSpill(t, &DB{Key: []byte("0123456789abcdef")})
+}
+
+func TestDB_SpillCompress(t *testing.T) {
+	testSpill(t, &DB{Compress: true})
+}
+
+func TestDB_SpillBufferPool(t *testing.T) {
+	testSpill(t, &DB{BufferPool: 8})
+}
+
+func TestDB_GroupCommit(t *testing.T) {
+	d := newD(t, &DB{GroupCommitSize: 16, GroupCommitDelay: time.Millisecond, Archive: true})
+	const writers, n = 32, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprintf("w%02d-%03d", w, i))
+				if err := d.db.Set(key, key); err != nil {
+					errs <- err
+					return
+				}
+				// every writer gets the result of its own Del
+				if i%5 == 0 {
+					if ok, err := d.db.Del(key); !ok || err != nil {
+						errs <- fmt.Errorf("Del(%s) = %v, %v", key, ok, err)
+						return
+					}
+					if ok, err := d.db.Del(key); ok || err != nil {
+						errs <- fmt.Errorf("Del(%s) again = %v, %v", key, ok, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < n; i++ {
+			if key := fmt.Sprintf("w%02d-%03d", w, i); i%5 != 0 {
+				d.ref[key] = key
+			}
+		}
+	}
+
+	writes := writers * n * 7 / 5
+	s, err := d.db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Commits >= uint64(writes) {
+		t.Fatalf("%d commits for %d writes", s.Commits, writes)
+	}
+	t.Logf("%d commits for %d writes", s.Commits, writes)
+	segments, err := archiveSegments(d.db.Path)
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("%d segments, %v", len(segments), err)
+	}
+	if _, records, _, err := archiveRead(segments[0].path); err != nil || len(records) != writes {
+		t.Fatalf("%d records archived for %d writes, %v", len(records), writes, err)
+	}
+
+	d.verify()
+	d.reopen()
+	d.verify()
+	if report, _ := d.db.Check(); !report.OK() || report.Keys != len(d.ref) {
+		t.Fatalf("unexpected report:\n%v", report)
+	}
+}
+
+func TestDB_GroupCommitFailure(t *testing.T) {
+	d := testDB(t, &DB{})
+	d.db.GroupCommitSize, d.db.GroupCommitDelay = 8, 10*time.Millisecond
+
+	// writes of a group fail together while the file is written through a read-only handle
+	fp := d.db.fp
+	ro, err := os.Open(d.db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.db.fp = ro
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w%2 == 0 {
+				key := []byte(fmt.Sprintf("failed%d", w))
+				if err := d.db.Set(key, []byte(strings.Repeat("val ", 100))); err == nil {
+					errs <- fmt.Errorf("Set(%s) into a read-only handle succeeded", key)
+				}
+			} else if ok, err := d.db.Del([]byte(fmt.Sprintf("key%05d", w))); ok || err == nil {
+				errs <- fmt.Errorf("Del into a read-only handle = %v, %v", ok, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	d.db.fp = fp
+	_ = ro.Close()
+
+	// the whole group is rolled back, and is not committed by the next group
+	d.add("next", "val")
+	d.verify()
+	d.reopen()
+	d.verify()
+	d.check()
+}
+
+func TestDB_Vacuum(t *testing.T) {
+	for _, db := range []*DB{{}, {Compress: true}} {
+		d := testDB(t, db)
+		out := newD(t, &DB{Compress: db.Compress})
+		if err := d.db.Vacuum(out.db); err != nil {
+			t.Fatal(err)
+		}
+		out.ref = d.ref
+		out.reopen()
+		out.verify()
+		if fileSize(t, out.db.Path) >= fileSize(t, d.db.Path) {
+			t.Errorf("vacuumed file is not smaller: %d >= %d", fileSize(t, out.db.Path), fileSize(t, d.db.Path))
+		}
+		if report, _ := out.db.Check(); !report.OK() || report.Keys != len(d.ref) {
+			t.Fatalf("unexpected report:\n%v", report)
+		}
+	}
+}
+
+func TestDB_VacuumIntKeys(t *testing.T) {
+	d := newD(t, &DB{IntKeys: true})
+	for i := uint64(1); i <= 2000; i++ {
+		d.add(string(bptree.U64Key(i*7919%2000+1)), fmt.Sprintf("val%d", i))
+	}
+
+	// the dummy key of the int layout is not copied as key 0
+	out := newD(t, &DB{IntKeys: true})
+	if err := d.db.Vacuum(out.db); err != nil {
+		t.Fatal(err)
+	}
+	out.ref = d.ref
+	out.reopen()
+	out.verify()
+	out.check()
+	if _, ok, err := out.db.Get(bptree.U64Key(0)); ok || err != nil {
+		t.Fatalf("the dummy key is found %v", err)
+	}
+}
+
+// writerFunc calls a function on every write.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func testBackup(t *testing.T, db *DB) {
+	d := testDB(t, db)
+	if db.Key != nil {
+		// encrypted files are only backed up as plaintext on request
+		if _, err := d.db.Backup(io.Discard); !errors.Is(err, ErrBackupEncrypted) {
+			t.Fatalf("expected ErrBackupEncrypted, got %v", err)
+		}
+		d.db.PlaintextBackup = true
+	}
+	snapshot := map[string]string{}
+	for k, v := range d.ref {
+		snapshot[k] = v
+	}
+
+	// writers keep going while the backup is streamed
+	out, err := os.Create(filepath.Join(t.TempDir(), "backup.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	w := writerFunc(func(p []byte) (int, error) {
+		if i == 0 && !d.db.Compress {
+			if _, err := d.db.Compact(); !errors.Is(err, ErrBackupPinned) {
+				t.Fatalf("expected ErrBackupPinned, got %v", err)
+			}
+		}
+		d.add(fmt.Sprintf("key%05d", i%2000), fmt.Sprintf("during backup %d", i))
+		d.del(fmt.Sprintf("key%05d", (i+1000)%2000))
+		i++
+		return out.Write(p)
+	})
+	n, err := d.db.Backup(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != fileSize(t, out.Name()) {
+		t.Fatalf("%d bytes written, file size %d", n, fileSize(t, out.Name()))
+	}
+
+	// the backup is the snapshot
+	b := &D{t: t, db: &DB{Path: out.Name()}, ref: snapshot}
+	if err := b.db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.db.Close()
+	b.verify()
+	if report, err := b.db.Check(); err != nil || !report.OK() || report.Keys != len(snapshot) {
+		t.Fatalf("unexpected report of backup:\n%v", report)
+	}
+
+	// pages kept aside are freed afterward
+	d.verify()
+	if report, err := d.db.Check(); err != nil || !report.OK() {
+		t.Fatalf("unexpected report:\n%v", report)
+	}
+	d.add("after", "backup")
+	d.reopen()
+	d.verify()
+	if report, err := d.db.Check(); err != nil || !report.OK() {
+		t.Fatalf("unexpected report:\n%v", report)
+	}
+}
+
+func TestDB_Backup(t *testing.T) {
+	testBackup(t, &DB{})
+}
+
+func TestDB_BackupCompress(t *testing.T) {
+	testBackup(t, &DB{Compress: true})
+}
+
+func TestDB_BackupEncrypt(t *testing.T) {
+	testBackup(t, &DB{Key: []byte("0123456789abcdef")})
+}
+
+func testBackupSince(t *testing.T, db *DB) {
+	d := testDB(t, db)
+	dir := t.TempDir()
+	backupTo := func(name string, backup func(w io.Writer) (int64, error)) (string, map[string]string) {
+		fp, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		if _, err := backup(fp); err != nil {
+			t.Fatal(err)
+		}
+		snapshot := map[string]string{}
+		for k, v := range d.ref {
+			snapshot[k] = v
+		}
+		return fp.Name(), snapshot
+	}
+	generation := func(path string) uint64 {
+		gen, err := BackupGeneration(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gen
+	}
+
+	base, _ := backupTo("base.db", d.db.Backup)
+	if generation(base) != d.db.Generation() {
+		t.Fatalf("backup at generation %d, expected %d", generation(base), d.db.Generation())
+	}
+	for i := 0; i < 100; i++ {
+		d.add(fmt.Sprintf("key%05d", i*13%2000), fmt.Sprintf("delta1 %d", i))
+		d.del(fmt.Sprintf("key%05d", i*17%2000))
+	}
+	delta1, _ := backupTo("delta1", func(w io.Writer) (int64, error) { return d.db.BackupSince(generation(base), w) })
+	if fileSize(t, delta1) >= fileSize(t, base) {
+		t.Fatalf("delta of %d bytes, backup of %d bytes", fileSize(t, delta1), fileSize(t, base))
+	}
+	// generations of pages are kept across reopens
+	d.reopen()
+	for i := 0; i < 100; i++ {
+		d.add(fmt.Sprintf("new%05d", i), fmt.Sprintf("delta2 %d", i))
+	}
+	delta2, snapshot := backupTo("delta2", func(w io.Writer) (int64, error) { return d.db.BackupSince(generation(delta1), w) })
+
+	apply := func(path string, delta string) error {
+		fp, err := os.Open(delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		return ApplyDelta(path, fp)
+	}
+	if err := apply(base, delta2); err == nil {
+		t.Fatal("delta applied onto a wrong base")
+	}
+	for _, delta := range []string{delta1, delta2} {
+		if err := apply(base, delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if generation(base) != d.db.Generation() {
+		t.Fatalf("restored at generation %d, expected %d", generation(base), d.db.Generation())
+	}
+
+	r := &D{t: t, db: &DB{Path: base}, ref: snapshot}
+	if err := r.db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.db.Close()
+	r.verify()
+	if report, err := r.db.Check(); err != nil || !report.OK() || report.Keys != len(snapshot) {
+		t.Fatalf("unexpected report of restored file:\n%v", report)
+	}
+}
+
+func TestDB_BackupSince(t *testing.T) {
+	testBackupSince(t, &DB{})
+}
+
+func TestDB_BackupSinceCompress(t *testing.T) {
+	testBackupSince(t, &DB{Compress: true})
+}
+
+func TestDB_RestoreToTime(t *testing.T) {
+	d := newD(t, &DB{Archive: true, ArchiveSegmentSize: 4096})
+	for i := 0; i < 200; i++ {
+		d.add(fmt.Sprintf("key%05d", i), fmt.Sprintf("base %d", i))
+	}
+	base := filepath.Join(t.TempDir(), "base.db")
+	out, err := os.Create(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.db.Backup(out); err != nil {
+		t.Fatal(err)
+	}
+	_ = out.Close()
+
+	for i := 0; i < 200; i += 2 {
+		d.add(fmt.Sprintf("key%05d", i), fmt.Sprintf("first %d", i))
+		d.del(fmt.Sprintf("key%05d", i+1))
+	}
+	snapshot := map[string]string{}
+	for k, v := range d.ref {
+		snapshot[k] = v
+	}
+	instant := time.Now()
+	time.Sleep(time.Millisecond)
+	// the archive goes on across reopens
+	d.reopen()
+	for i := 0; i < 100; i++ {
+		d.add(fmt.Sprintf("new%05d", i), "second")
+	}
+	if segments, err := archiveSegments(d.db.Path); err != nil || len(segments) < 2 {
+		t.Fatalf("segments are not rotated: %v %v", segments, err)
+	}
+
+	restore := func(to time.Time, ref map[string]string) error {
+		path := filepath.Join(t.TempDir(), "restored.db")
+		data, err := os.ReadFile(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		r := &D{t: t, db: &DB{Path: path}, ref: ref}
+		if err := r.db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer r.db.Close()
+		if _, err := r.db.RestoreToTime(d.db.Path, to); err != nil {
+			return err
+		}
+		r.verify()
+		if report, err := r.db.Check(); err != nil || !report.OK() || report.Keys != len(ref) {
+			t.Fatalf("unexpected report of restored file:\n%v", report)
+		}
+		return nil
+	}
+	if err := restore(instant, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(time.Now(), d.ref); err != nil {
+		t.Fatal(err)
+	}
+
+	// commits changing no KV leave no gap
+	if _, err := d.db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.db.Defragment(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	d.reopen()
+	d.add("after", "compact")
+	// records of a commit whose meta page is not written are dropped
+	d.db.archive.pending = []archiveRecord{{op: ARCHIVE_SET, key: []byte("torn"), val: []byte("commit")}}
+	if err := archiveAppend(d.db); err != nil {
+		t.Fatal(err)
+	}
+	d.db.archive.pending = nil
+	d.reopen()
+	d.add("after", "crash")
+	if err := restore(time.Now(), d.ref); err != nil {
+		t.Fatal(err)
+	}
+
+	// commits made without the archive leave a gap
+	d.db.Archive = false
+	d.reopen()
+	d.add("unarchived", "gap")
+	d.db.Archive = true
+	d.reopen()
+	d.add("after", "gap")
+	if err := restore(time.Now(), d.ref); err == nil || !strings.Contains(err.Error(), "gap") {
+		t.Fatalf("expected a gap, got %v", err)
+	}
+}
+
+func TestDB_FormatUpgrade(t *testing.T) {
+	d := newD(t, &DB{})
+	for i := 0; i < 100; i++ {
+		d.add(fmt.Sprintf("key%05d", i), fmt.Sprintf("val%d", i))
+	}
+	if err := d.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	meta := func() []byte {
+		data := make([]byte, META_SIZE)
+		fp, err := os.Open(d.db.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		if _, err := fp.ReadAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	patch := func(off int, field []byte) {
+		fp, err := os.OpenFile(d.db.Path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		if _, err := fp.WriteAt(field, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func() error {
+		*d.db = DB{Path: d.db.Path}
+		return d.db.Open()
+	}
+	u64 := func(v uint64) []byte { return binary.LittleEndian.AppendUint64(nil, v) }
+
+	// a file of version 0 is upgraded by the next commit
+	patch(META_VERSION, make([]byte, META_SIZE-META_VERSION))
+	if err := open(); err != nil {
+		t.Fatal(err)
+	}
+	d.verify()
+	if version := binary.LittleEndian.Uint32(meta()[META_VERSION:]); version != 0 {
+		t.Fatalf("version %d after open", version)
+	}
+	d.add("upgrade", "commit")
+	if version := binary.LittleEndian.Uint32(meta()[META_VERSION:]); version != FORMAT_VERSION {
+		t.Fatalf("version %d after upgrade", version)
+	}
+	if optional := binary.LittleEndian.Uint64(meta()[META_OPTIONAL:]); optional != META_OPTIONALS {
+		t.Fatalf("optional features %#x after upgrade", optional)
+	}
+
+	// unknown optional features are kept
+	_ = d.db.Close()
+	patch(META_OPTIONAL, u64(META_OPTIONALS|1<<40))
+	if err := open(); err != nil {
+		t.Fatal(err)
+	}
+	d.add("optional", "feature")
+	if optional := binary.LittleEndian.Uint64(meta()[META_OPTIONAL:]); optional != META_OPTIONALS|1<<40 {
+		t.Fatalf("optional features %#x after a commit", optional)
+	}
+
+	// unknown required features and other page sizes are refused
+	_ = d.db.Close()
+	flags := binary.LittleEndian.Uint64(meta()[40:])
+	patch(40, u64(flags|1<<40))
+	if err := open(); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	}
+	patch(40, u64(flags))
+	patch(META_PAGE_SIZE, binary.LittleEndian.AppendUint32(nil, 2*bptree.PAGE_SIZE))
+	if err := open(); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	}
+	patch(META_PAGE_SIZE, binary.LittleEndian.AppendUint32(nil, bptree.PAGE_SIZE))
+	if err := open(); err != nil {
+		t.Fatal(err)
+	}
+	d.verify()
+}
+
+func testInspect(t *testing.T, db *DB) {
+	d := testDB(t, db)
+	inspect(t, d)
+
+	// the inspector decodes what later commits wrote, and the file as reopened
+	for i := 0; i < 2000; i += 5 {
+		d.add(fmt.Sprintf("key%05d", i), "later")
+	}
+	for i := 1; i < 2000; i += 40 {
+		d.del(fmt.Sprintf("key%05d", i))
+	}
+	inspect(t, d)
+	d.reopen()
+	inspect(t, d)
+}
+
+// inspect checks the nodes, the freelists and the meta page decoded by the inspector against Check.
+func inspect(t *testing.T, d *D) {
+	report, err := d.db.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pages are inspected after the walk, which holds the lock
+	visited := map[uint64]bptree.Node{}
+	leaves := 0
+	err = d.db.InspectTree(func(ptr uint64, parent uint64, depth int, node bptree.Node) {
+		visited[ptr] = bytes.Clone(node)
+		if node.Type() == bptree.BNODE_LEAF {
+			leaves += int(node.NumKeys())
+		}
+	})
+	if err != nil || len(visited) != report.Nodes || leaves-1 != report.Keys {
+		t.Fatalf("tree of %d nodes, %d keys: %v", len(visited), leaves-1, err)
+	}
+	for ptr, node := range visited {
+		page, err := d.db.InspectPage(pageOf(d.db, ptr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, info := range page.Nodes {
+			// extents are known by their first sector, since they may be larger than their content
+			if !d.db.Compress && info.Ptr == ptr || d.db.Compress && extentSector(info.Ptr) == extentSector(ptr) {
+				found = info.Problem == "" && bytes.Equal(info.Node[:node.Size()], node[:node.Size()])
+			}
+		}
+		if !found {
+			t.Fatalf("node %d not decoded:\n%v", ptr, page)
+		}
+	}
+
+	lists, err := d.db.InspectFreeLists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	free, freeNodes := 0, 0
+	for _, list := range lists {
+		free, freeNodes = free+len(list.Items), freeNodes+len(list.Nodes)
+	}
+	if free != report.Free || freeNodes != report.FreeNodes {
+		t.Fatalf("freelists of %d nodes, %d free", freeNodes, free)
+	}
+	meta := d.db.InspectMeta()
+	if meta.Root != d.db.tree.Root || meta.Version != FORMAT_VERSION || meta.Commit != d.db.Generation() {
+		t.Fatalf("unexpected meta page:\n%v", meta)
+	}
+}
+
+func TestDB_Inspect(t *testing.T) {
+	testInspect(t, &DB{})
+}
+
+func TestDB_InspectCompress(t *testing.T) {
+	testInspect(t, &DB{Compress: true})
+}
+
+func testStats(t *testing.T, db *DB) {
+	d := testDB(t, db)
+	for i := 0; i < 10; i++ {
+		d.add(fmt.Sprintf("stats%d", i), "value")
+	}
+	// counters are kept since the last reopen of testDB
+	s := stats(t, d)
+	if s.Commits != 10 || s.PagesWritten < 10 || s.Fsyncs < 2*s.Commits {
+		t.Fatalf("unexpected counters:\n%v", s)
+	}
+
+	for i := 0; i < 2000; i++ {
+		d.add(fmt.Sprintf("key%05d", i), strings.Repeat("v", i%100))
+	}
+	stats(t, d)
+	d.reopen()
+	d.add("stats", "reopened")
+	s = stats(t, d)
+	if s.Commits != 1 || s.Height < 2 {
+		t.Fatalf("unexpected stats:\n%v", s)
+	}
+}
+
+// stats checks the statistics against Check and the reference map.
+func stats(t *testing.T, d *D) *Stats {
+	s, err := d.db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := d.db.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Height != report.Height || s.Internals+s.Leaves != report.Nodes || s.Keys != len(d.ref) {
+		t.Fatalf("unexpected stats:\n%v", s)
+	}
+	// extents of several nodes share pages
+	live := uint64(1 + report.Nodes)
+	if s.Free != report.Free || s.FreeNodes != report.FreeNodes || s.LivePages > live ||
+		!d.db.Compress && s.LivePages != live {
+		t.Fatalf("unexpected stats:\n%v", s)
+	}
+	keyBytes, valBytes := int64(0), int64(0)
+	for k, v := range d.ref {
+		keyBytes, valBytes = keyBytes+int64(len(k)), valBytes+int64(len(v))
+	}
+	if s.KeyBytes != keyBytes || s.ValBytes != valBytes {
+		t.Fatalf("%d key bytes and %d value bytes, expected %d and %d", s.KeyBytes, s.ValBytes, keyBytes, valBytes)
+	}
+	if s.Levels[0].Nodes != 1 || s.Levels[s.Height-1].Nodes != s.Leaves {
+		t.Fatalf("unexpected levels:\n%v", s)
+	}
+	return s
+}
+
+func TestDB_Stats(t *testing.T) {
+	testStats(t, &DB{})
+}
+
+func TestDB_StatsCompress(t *testing.T) {
+	testStats(t, &DB{Compress: true})
+}
+
+func testFillFactor(t *testing.T, db *DB) {
+	d := newD(t, db)
+	for i := 0; i < 5000; i++ {
+		d.add(fmt.Sprintf("seq%08d", i), strings.Repeat("v", 50))
+	}
+	fill := fillFactor(t, d)
+
+	// the fill is kept in the reopened file, and keys appended later are packed alike
+	d.reopen()
+	d.verify()
+	if f := fillFactor(t, d); f != fill {
+		t.Fatalf("leaves filled to %.3f after a reopen, expected %.3f", f, fill)
+	}
+	for i := 5000; i < 10000; i++ {
+		d.add(fmt.Sprintf("seq%08d", i), strings.Repeat("v", 50))
+	}
+	fillFactor(t, d)
+	d.verify()
+}
+
+// fillFactor checks the fill of the leaves against the fill factor of the database, and returns it.
+func fillFactor(t *testing.T, d *D) float64 {
+	s, err := d.db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a lower bound of the fill of the leaves but the last one, which is partially filled
+	leaves := s.Levels[s.Height-1]
+	fill := (leaves.Fill*float64(leaves.Nodes) - 1) / float64(leaves.Nodes-1)
+	want := d.db.FillFactor
+	if want == 0 {
+		want = 1
+	}
+	if fill < want-0.05 || fill > want {
+		t.Fatalf("fill factor %v: leaves filled to %.3f", d.db.FillFactor, fill)
+	}
+	return fill
+}
+
+func TestDB_FillFactor(t *testing.T) {
+	testFillFactor(t, &DB{})
+}
+
+func TestDB_FillFactor80(t *testing.T) {
+	testFillFactor(t, &DB{FillFactor: 0.8})
+}
+
+func testSpaceByPrefix(t *testing.T, db *DB) {
+	d := newD(t, db)
+	for i := 0; i < 300; i++ {
+		d.add(fmt.Sprintf("tenant%d:%05d", i%3, i), strings.Repeat("v", i%3*10))
+	}
+	d.add("nodelimiter", "")
+
+	r := spaceByPrefix(t, d, PrefixOptions{Delimiter: []byte(":")})
+	prefixes := []string{}
+	for _, u := range r.Buckets {
+		prefixes = append(prefixes, u.Prefix)
+	}
+	// the largest values come first
+	if strings.Join(prefixes, " ") != "tenant2: tenant1: tenant0: nodelimiter" {
+		t.Fatalf("unexpected buckets:\n%v", r)
+	}
+	if u := r.Buckets[0]; u.Keys != 100 || u.KeyBytes != 100*int64(len("tenant2:00000")) || u.ValBytes != 100*20 {
+		t.Fatalf("unexpected bucket %+v", u)
+	}
+	r = spaceByPrefix(t, d, PrefixOptions{Length: 6})
+	if len(r.Buckets) != 2 || r.Buckets[0].Prefix != "tenant" || r.Buckets[0].Keys != 300 {
+		t.Fatalf("unexpected buckets:\n%v", r)
+	}
+
+	// tenant0 grows past the others, and tenant2 is removed
+	for i := 0; i < 300; i += 3 {
+		d.add(fmt.Sprintf("tenant0:%05d", i), strings.Repeat("v", 50))
+		d.del(fmt.Sprintf("tenant2:%05d", i+2))
+	}
+	d.reopen()
+	r = spaceByPrefix(t, d, PrefixOptions{Delimiter: []byte(":")})
+	if len(r.Buckets) != 3 || r.Buckets[0].Prefix != "tenant0:" || r.Buckets[0].ValBytes != 100*50 {
+		t.Fatalf("unexpected buckets after later writes:\n%v", r)
+	}
+}
+
+// spaceByPrefix checks the buckets of the space usage against the keys written.
+func spaceByPrefix(t *testing.T, d *D, opts PrefixOptions) *PrefixReport {
+	r, err := d.db.SpaceByPrefix(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]PrefixUsage{}
+	for k, v := range d.ref {
+		u := want[string(opts.prefix([]byte(k)))]
+		u.Keys, u.KeyBytes, u.ValBytes = u.Keys+1, u.KeyBytes+int64(len(k)), u.ValBytes+int64(len(v))
+		want[string(opts.prefix([]byte(k)))] = u
+	}
+	total := int64(0)
+	for _, u := range r.Buckets {
+		w := want[u.Prefix]
+		if u.Keys != w.Keys || u.KeyBytes != w.KeyBytes || u.ValBytes != w.ValBytes {
+			t.Fatalf("bucket %+v, expected %+v", u, w)
+		}
+		total += u.Bytes
+	}
+	if len(r.Buckets) != len(want) || r.Bytes != total || r.Bytes > r.LeafBytes {
+		t.Fatalf("unexpected buckets:\n%v", r)
+	}
+	return r
+}
+
+func TestDB_SpaceByPrefix(t *testing.T) {
+	testSpaceByPrefix(t, &DB{})
+}
+
+func TestDB_SpaceByPrefixCompress(t *testing.T) {
+	testSpaceByPrefix(t, &DB{Compress: true})
+}
+
+func testObserver(t *testing.T, db *DB) {
+	o := &PrometheusObserver{}
+	db.Observer = o
+	d := newD(t, db)
+	for i := 0; i < 300; i++ {
+		d.add(fmt.Sprintf("key%05d", i), strings.Repeat("v", 100))
+	}
+	for i := 0; i < 300; i += 2 {
+		d.del(fmt.Sprintf("key%05d", i))
+	}
+	d.verify()
+
+	m := metrics(t, o)
+	if m["misql_commits_total"] != 450 || m["misql_commit_errors_total"] != 0 {
+		t.Fatalf("unexpected metrics:\n%v", m)
+	}
+	for _, name := range []string{"misql_fsyncs_total", "misql_pages_allocated_total", "misql_pages_freed_total",
+		"misql_page_reads_total", "misql_file_extensions_total", "misql_file_size_bytes"} {
+		if m[name] <= 0 {
+			t.Fatalf("%s is not counted:\n%v", name, m)
+		}
+	}
+
+	// the observer is shared by the reopened database, and counts as its statistics do
+	d.reopen()
+	m = metrics(t, o)
+	before, err := d.db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		d.add(fmt.Sprintf("key%05d", i*3), "later")
+	}
+	d.verify()
+	after, err := d.db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := metrics(t, o)
+	if later["misql_commits_total"]-m["misql_commits_total"] != float64(after.Commits-before.Commits) ||
+		after.Commits-before.Commits != 100 || later["misql_commit_errors_total"] != 0 ||
+		later["misql_fsyncs_total"]-m["misql_fsyncs_total"] != float64(after.Fsyncs-before.Fsyncs) ||
+		later["misql_pages_allocated_total"] <= m["misql_pages_allocated_total"] {
+		t.Fatalf("unexpected metrics after later writes:\n%v\n%v", later, after)
+	}
+}
+
+// metrics scrapes the counters of an observer.
+func metrics(t *testing.T, o *PrometheusObserver) map[string]float64 {
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	m := map[string]float64{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		var name string
+		var value float64
+		if !strings.HasPrefix(line, "#") && line != "" {
+			if _, err := fmt.Sscan(line, &name, &value); err != nil {
+				t.Fatalf("bad line %q: %v", line, err)
+			}
+			m[name] = value
+		}
+	}
+	return m
+}
+
+func TestDB_Observer(t *testing.T) {
+	testObserver(t, &DB{})
+}
+
+func TestDB_ObserverCompress(t *testing.T) {
+	testObserver(t, &DB{Compress: true})
+}
+
+func testBufferPool(t *testing.T, db *DB) {
+	db.BufferPool = 8
+	d := testDB(t, db)
+	d.check()
+	// Check reads every node, replacing frames as it goes
+	if len(d.db.pool.frames) != 8 || d.db.pool.evictions == 0 {
+		t.Fatalf("%d frames, %d evictions", len(d.db.pool.frames), d.db.pool.evictions)
+	}
+	if s, err := d.db.Stats(); err != nil || s.PoolFrames != 8 || s.PoolMisses == 0 || s.PoolHits == 0 {
+		t.Fatalf("unexpected stats %v:\n%v", err, s)
+	}
+	if !d.db.Compress && d.db.Key == nil {
+		if _, err := d.db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		d.verify()
+	}
+
+	// later writes and a reopen read the values written, and keep the pool bounded
+	for i := 0; i < 2000; i += 3 {
+		d.add(fmt.Sprintf("key%05d", i), "later")
+	}
+	for i := 1; i < 2000; i += 30 {
+		d.del(fmt.Sprintf("key%05d", i))
+	}
+	d.reopen()
+	d.verify()
+	if len(d.db.pool.frames) != 8 {
+		t.Fatalf("%d frames", len(d.db.pool.frames))
+	}
+
+	// the file is the same through the mmap
+	d.db.BufferPool, d.db.DirectIO = 0, false
+	d.reopen()
+	d.verify()
+	d.check()
+}
+
+func TestDB_BufferPool(t *testing.T) {
+	testBufferPool(t, &DB{})
+}
+
+func TestDB_BufferPoolCompress(t *testing.T) {
+	testBufferPool(t, &DB{Compress: true})
+}
+
+func TestDB_BufferPoolEncrypt(t *testing.T) {
+	testBufferPool(t, &DB{Key: []byte("0123456789abcdef")})
+}
+
+func TestDB_DirectIO(t *testing.T) {
+	testBufferPool(t, &DB{DirectIO: true})
+}
+
+func TestDB_DirectIOCompress(t *testing.T) {
+	testBufferPool(t, &DB{DirectIO: true, Compress: true})
+}
+
+func TestDB_DirectIOEncrypt(t *testing.T) {
+	testBufferPool(t, &DB{DirectIO: true, Key: []byte("0123456789abcdef")})
+}
+
+func testIOUring(t *testing.T, db *DB) {
+	if runtime.GOOS != "linux" {
+		t.Skip("io_uring is only available on Linux")
+	}
+	db.IOUring = true
+	d := testDB(t, db)
+	d.check()
+
+	// a commit of more pages than the ring holds is submitted in batches
+	for i := 0; i < 2*RING_ENTRIES; i++ {
+		d.add(fmt.Sprintf("big%05d", i), strings.Repeat("v", 2000))
+	}
+	if !d.db.Compress {
+		before, _ := d.db.Stats()
+		if err := d.db.Rekey([]byte("0123456789abcdef")); err != nil {
+			t.Fatal(err)
+		}
+		after, _ := d.db.Stats()
+		if after.PagesWritten-before.PagesWritten <= RING_ENTRIES {
+			t.Fatalf("%d pages written by a commit", after.PagesWritten-before.PagesWritten)
+		}
+	}
+	d.verify()
+
+	// the reopened database submits later commits to a ring of its own
+	d.reopen()
+	if d.db.ring == nil {
+		t.Fatal("no ring after a reopen")
+	}
+	for i := 0; i < 2000; i += 3 {
+		d.del(fmt.Sprintf("key%05d", i))
+	}
+	d.add("uring", "value")
+	if s, err := d.db.Stats(); err != nil || s.Commits == 0 || s.PagesWritten == 0 || s.Fsyncs == 0 {
+		t.Fatalf("unexpected stats %v:\n%v", err, s)
+	}
+	d.check()
+	d.reopen()
+	d.verify()
+}
+
+func TestDB_IOUring(t *testing.T) {
+	testIOUring(t, &DB{})
+}
+
+func TestDB_IOUringCompress(t *testing.T) {
+	testIOUring(t, &DB{Compress: true})
+}
+
+func TestDB_IOUringDirectIO(t *testing.T) {
+	testIOUring(t, &DB{DirectIO: true, BufferPool: 8})
+}
+
+func TestDB_IOUringDirectIOCompress(t *testing.T) {
+	testIOUring(t, &DB{DirectIO: true, BufferPool: 8, Compress: true})
+}
+
+func testScan(t *testing.T, db *DB) {
+	d := testDB(t, db)
+	scans(t, d)
+
+	// the scans see later writes, and read ahead again in the reopened database
+	for i := 0; i < 2000; i += 4 {
+		d.add(fmt.Sprintf("key%05d", i), "later")
+	}
+	for i := 2; i < 2000; i += 8 {
+		d.del(fmt.Sprintf("key%05d", i))
+	}
+	d.reopen()
+	scans(t, d)
+}
+
+// scans checks scans of all the keys, of a range, and of a limited number of keys against the keys written.
+func scans(t *testing.T, d *D) {
+	keys := []string{}
+	for k := range d.ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	scan := func(start, end []byte, limit int) []string {
+		got := []string{}
+		err := d.db.Scan(start, end, func(key, val []byte) bool {
+			if d.ref[string(key)] != string(val) {
+				t.Fatalf("%s: %s is not equal to %s", key, val, d.ref[string(key)])
+			}
+			got = append(got, string(key))
+			if d.db.BufferPool > 0 && len(d.db.pool.frames) > d.db.BufferPool {
+				t.Fatalf("%d frames during the scan", len(d.db.pool.frames))
+			}
+			return len(got) < limit
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	if got := scan(nil, nil, len(keys)+1); !slices.Equal(got, keys) {
+		t.Fatalf("%d keys scanned out of %d", len(got), len(keys))
+	}
+	begin, end := sort.SearchStrings(keys, "key00500"), sort.SearchStrings(keys, "key01000")
+	if got := scan([]byte("key00500"), []byte("key01000"), len(keys)); !slices.Equal(got, keys[begin:end]) {
+		t.Fatalf("unexpected range %v ... %v", got[0], got[len(got)-1])
+	}
+	if got := scan([]byte("key00700x"), nil, 3); !slices.Equal(got, keys[sort.SearchStrings(keys, "key00700x"):][:3]) {
+		t.Fatalf("unexpected keys %v", got)
+	}
+
+	s, _ := d.db.Stats()
+	if (s.Readahead > 0) != (d.db.BufferPool == 0 && d.db.Readahead >= 0) {
+		t.Fatalf("%d pages read ahead", s.Readahead)
+	}
+}
+
+func TestDB_Scan(t *testing.T) {
+	testScan(t, &DB{})
+}
+
+func TestDB_ScanCompress(t *testing.T) {
+	testScan(t, &DB{Compress: true})
+}
+
+func TestDB_ScanNoReadahead(t *testing.T) {
+	testScan(t, &DB{Readahead: -1, NoRandomAdvice: true})
+}
+
+func TestDB_ScanBufferPool(t *testing.T) {
+	testScan(t, &DB{BufferPool: 8})
+}
+
+// pagerModes are the pagers benchmarked against each other.
+var pagerModes = []struct {
+	name       string
+	bufferPool int
+	directIO   bool
+	ioUring    bool
+}{{"Mmap", 0, false, false}, {"BufferPool", 256, false, false}, {"DirectIO", 256, true, false},
+	{"IOUring", 0, false, true}}
+
+func benchmarkPagers(b *testing.B, bench func(b *testing.B, db *DB)) {
+	for _, mode := range pagerModes {
+		b.Run(mode.name, func(b *testing.B) {
+			db := &DB{Path: filepath.Join(b.TempDir(), "bench.db"), BufferPool: mode.bufferPool, DirectIO: mode.directIO,
+				IOUring: mode.ioUring}
+			if err := db.Open(); err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			bench(b, db)
+		})
+	}
+}
+
+func BenchmarkDB_Set(b *testing.B) {
+	benchmarkPagers(b, func(b *testing.B, db *DB) {
+		for i := 0; i < b.N; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%08d", i*7919%b.N)), []byte("val")); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDB_Get(b *testing.B) {
+	benchmarkPagers(b, func(b *testing.B, db *DB) {
+		const n = 5000
+		for i := 0; i < n; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%08d", i)), bytes.Repeat([]byte("v"), 100)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok, err := db.Get([]byte(fmt.Sprintf("key%08d", i*7919%n))); err != nil || !ok {
+				b.Fatal(err)
+			}
+		}
+	})
+}
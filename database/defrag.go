@@ -0,0 +1,169 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"bytes"
+	"fmt"
+)
+
+/*
+
+Defragmentation
+
+Copy-on-write updates scatter the leaves of a key range over the file. Defragment rewrites the leaves overlapping a
+range into a run of contiguous pages in key order, in a single commit, so a scan of the range reads the file
+sequentially. The ancestors of the leaves are rewritten as well, and take the pages following the leaves.
+
+The run is the lowest run of free pages long enough, or pages appended to the file. Pages of the run are taken out of
+the freelist, which is rebuilt as by Compact, with the old pages of the rewritten nodes.
+
+Compressed files are not defragmented, since their extents share pages, and fail with ErrCompressed.
+
+*/
+
+// Defragment rewrites the leaves overlapping the keys in [start, end), and their ancestors, into contiguous pages in
+// key order, and returns the amount of pages rewritten. A nil start is the first key, and a nil end is past the last
+// key.
+func (db *DB) Defragment(start, end []byte) (rewritten int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.Compress {
+		return 0, fmt.Errorf("Defragment: %w", ErrCompressed)
+	}
+	if err := readOnly(db, "Defragment"); err != nil {
+		return 0, err
+	}
+	if err := backupBusy(db, "Defragment"); err != nil {
+		return 0, err
+	}
+
+	meta := metaPageEncode(db)
+	defer func() {
+		if err != nil {
+			pageDiscard(db)
+			_ = metaPageDecode(db, meta)
+		}
+	}()
+	defer recoverCorrupt(db, meta, &err)
+
+	leaves, nInternal := defragNodes(db, start, end)
+	if defragSequential(leaves) {
+		return 0, nil
+	}
+	moved := map[uint64]bool{}
+	for _, ptr := range leaves {
+		moved[ptr] = true
+	}
+
+	// free pages, and nodes of the old freelist
+	free, fl := []uint64{}, []uint64{}
+	for ptr := db.fl.head; ptr != 0; {
+		node := db.fl.get(ptr)
+		fl = append(fl, ptr)
+		for i := 0; i < flnSize(node); i++ {
+			free = append(free, flnPtr(node, i))
+		}
+		ptr = flnNext(node)
+	}
+	free = sortedCopy(free)
+
+	n := len(leaves) + nInternal
+	run := make([]uint64, n)
+	if i, ok := defragRun(free, n); ok {
+		copy(run, free[i:i+n])
+		free = append(free[:i:i], free[i+n:]...)
+	} else {
+		for i := range run {
+			run[i] = db.page.nFlushed + db.page.nAppend
+			db.page.nAppend++
+		}
+	}
+
+	// Relocate allocates the leaves in key order, before their ancestors
+	nLeaf, nAncestor := 0, 0
+	db.tree.New = func(node bptree.Node) uint64 {
+		ptr := run[len(leaves)+nAncestor]
+		if node.Type() == bptree.BNODE_LEAF {
+			ptr = run[nLeaf]
+			nLeaf++
+		} else {
+			nAncestor++
+		}
+		pageStore(db, ptr, node, nil)
+		return ptr
+	}
+	defer func() { db.tree.New = db.pageNew }()
+	db.tree.Relocate(func(ptr uint64) bool { return moved[ptr] })
+
+	// old pages are referenced by the committed meta page, so they are listed but not reused for freelist nodes
+	freed := fl
+	for ptr, page := range db.page.updates {
+		if page == nil {
+			freed = append(freed, ptr)
+			delete(db.page.updates, ptr)
+		}
+	}
+	db.fl.head = 0
+	flPush(&db.fl, freed, free, 0)
+
+	if err := flushPages(db); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// defragNodes returns the leaves overlapping [start, end) in key order, and the amount of their ancestors.
+func defragNodes(db *DB, start, end []byte) ([]uint64, int) {
+	leaves, nInternal := []uint64{}, 0
+	// lo and hi bound the keys of a node, a nil hi is past the last key
+	var walk func(ptr uint64, lo, hi []byte)
+	walk = func(ptr uint64, lo, hi []byte) {
+		node := db.tree.Get(ptr)
+		if node.Type() == bptree.BNODE_LEAF {
+			leaves = append(leaves, ptr)
+			return
+		}
+		nInternal++
+		for i := uint16(0); i < node.NumKeys(); i++ {
+			kidLo, kidHi := node.Key(i), hi
+			if i+1 < node.NumKeys() {
+				kidHi = node.Key(i + 1)
+			}
+			if i == 0 {
+				kidLo = lo
+			}
+			if (end == nil || kidLo == nil || bytes.Compare(kidLo, end) < 0) &&
+				(start == nil || kidHi == nil || bytes.Compare(kidHi, start) > 0) {
+				walk(node.Ptr(i), kidLo, kidHi)
+			}
+		}
+	}
+	if db.tree.Root != 0 {
+		walk(db.tree.Root, nil, nil)
+	}
+	return leaves, nInternal
+}
+
+// defragSequential reports whether leaves are in consecutive pages.
+func defragSequential(leaves []uint64) bool {
+	for i := 1; i < len(leaves); i++ {
+		if leaves[i] != leaves[i-1]+1 {
+			return false
+		}
+	}
+	return true
+}
+
+// defragRun returns the index of the lowest run of n consecutive pages in sorted free pages, and whether there is one.
+func defragRun(free []uint64, n int) (int, bool) {
+	begin := 0
+	for i := range free {
+		if i > 0 && free[i] != free[i-1]+1 {
+			begin = i
+		}
+		if i-begin+1 == n {
+			return begin, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"fmt"
+	"unsafe"
+)
+
+/*
+
+Direct I/O
+
+With DB.DirectIO, the file is opened with O_DIRECT, or F_NOCACHE on darwin, so its pages are not cached by the kernel
+as well as by the process. The file is not mapped: pages are read into the buffer pool, which is the only cache, of
+DB.BufferPool frames, or DIRECT_POOL_PAGES if it is 0. Other platforms fail to open the file with
+errors.ErrUnsupported.
+
+Direct I/O transfers whole pages between aligned buffers and aligned offsets. Frames of the pool are aligned, pages are
+written from an aligned buffer, and a write within a page, such as an extent or the meta page, is made into the frame
+of the page, which is then written as a whole. Fsyncs are still needed, for the metadata of the file and the cache of
+the device.
+
+*/
+
+const (
+	DIRECT_ALIGN      = 4096 // alignment of buffers and offsets, the logical block size of most devices
+	DIRECT_POOL_PAGES = 4096 // default size of the buffer pool with direct I/O
+)
+
+// alignedBuf returns a buffer aligned to DIRECT_ALIGN.
+func alignedBuf(size int) []byte {
+	buf := make([]byte, size+DIRECT_ALIGN)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % DIRECT_ALIGN); rem != 0 {
+		offset = DIRECT_ALIGN - rem
+	}
+	return buf[offset : offset+size : offset+size]
+}
+
+// directOpen reopens the file for direct I/O.
+func directOpen(db *DB) error {
+	fp, err := directFile(db.Path, db.ReadOnly)
+	if err != nil {
+		return fmt.Errorf("directOpen: %w", err)
+	}
+	_ = db.fp.Close()
+	db.fp = fp
+	return nil
+}
+
+// directWrite writes data within a page of the file as a whole page.
+func directWrite(db *DB, offset int64, data []byte) error {
+	page := uint64(offset / bptree.PAGE_SIZE)
+	if ringActive(db) {
+		// the writes of the commit to a page are made into the buffer queued for the page
+		buf := ringPage(db, page, len(data) < bptree.PAGE_SIZE)
+		copy(buf[offset%bptree.PAGE_SIZE:], data)
+		return nil
+	}
+	if len(data) == bptree.PAGE_SIZE {
+		if db.direct == nil {
+			db.direct = alignedBuf(bptree.PAGE_SIZE)
+		}
+		copy(db.direct, data)
+		poolWritten(db, page, 0, data)
+		return filePwrite(db, db.direct, offset)
+	}
+	// the rest of the page is read into its frame, which is written before another page is read
+	frame := pageRaw(db, page)
+	copy(frame[offset%bptree.PAGE_SIZE:], data)
+	return filePwrite(db, frame, int64(page*bptree.PAGE_SIZE))
+}
@@ -0,0 +1,23 @@
+package database
+
+import (
+	"os"
+	"syscall"
+)
+
+// directFile opens a file bypassing the page cache.
+func directFile(path string, readOnly bool) (*os.File, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fp.Fd(), syscall.F_NOCACHE, 1); errno != 0 {
+		_ = fp.Close()
+		return nil, errno
+	}
+	return fp, nil
+}
@@ -0,0 +1,15 @@
+package database
+
+import (
+	"os"
+	"syscall"
+)
+
+// directFile opens a file bypassing the page cache.
+func directFile(path string, readOnly bool) (*os.File, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	return os.OpenFile(path, flag|syscall.O_DIRECT, 0644)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package database
+
+import (
+	"errors"
+	"os"
+)
+
+// directFile fails, since bypassing the page cache is not supported.
+func directFile(path string, readOnly bool) (*os.File, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,243 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+/*
+
+Encryption at rest
+
+With DB.Key, every page but the meta page is encrypted with AES-GCM. The nonce of a page is derived from its page
+number and the generation of the write:
+NONCE: page number(6B) - generation(6B)
+The generation and the tag of every page are stored in a sidecar file next to the database file:
+Path+GCM_SUFFIX: generation of page 0(8B) - tag of page 0(16B) - generation of page 1(8B) - ...
+
+Every writePages takes a new generation, so a nonce is never reused as long as generations are never reused. The meta
+page records a limit below which generations may have been used, which is raised before generations reach it. A
+crashed transaction may use generations above the last commit, but never above the limit.
+
+The meta page stores a key check value, which is the AES encryption of a zero block, so a wrong key fails on Open.
+Rekey switches the key in a single commit by rewriting every page in use.
+
+Compressed files rewrite pages shared with extents in use, so they are not supported, and fail with ErrCompressed.
+
+*/
+
+const (
+	GCM_SUFFIX  = ".gcm"
+	GCM_ENTRY   = 8 + 16
+	GEN_RESERVE = 1 << 16 // amount of generations reserved at a time
+	GEN_MAX     = 1 << 48
+)
+
+var ErrWrongKey = errors.New("wrong encryption key")
+
+// encryptCipher returns the AEAD and the key check value of a key.
+func encryptCipher(key []byte) (cipher.AEAD, [aes.BlockSize]byte, error) {
+	kcv := [aes.BlockSize]byte{}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, kcv, err
+	}
+	block.Encrypt(kcv[:], make([]byte, aes.BlockSize))
+	aead, err := cipher.NewGCM(block)
+	return aead, kcv, err
+}
+
+// encryptInit checks the key against the meta page, and loads the sidecar file of an encrypted file.
+func encryptInit(db *DB) error {
+	if db.fsize == 0 {
+		db.enc.encrypted = len(db.Key) > 0
+	}
+	if !db.enc.encrypted {
+		if len(db.Key) > 0 {
+			return errors.New("encryptInit: file is not encrypted, use Rekey to encrypt it")
+		}
+		return nil
+	}
+	if len(db.Key) == 0 {
+		return errors.New("encryptInit: file is encrypted, but no key is given")
+	}
+	if db.Compress {
+		return fmt.Errorf("encryptInit: encryption is %w", ErrCompressed)
+	}
+
+	aead, kcv, err := encryptCipher(db.Key)
+	if err != nil {
+		return fmt.Errorf("encryptInit: %w", err)
+	}
+	if db.fsize > 0 && kcv != db.enc.kcv {
+		return ErrWrongKey
+	}
+	db.enc.read, db.enc.write, db.enc.kcv = aead, aead, kcv
+	db.enc.gen = db.enc.limit
+	return encryptSidecarOpen(db)
+}
+
+// encryptSidecarOpen opens the sidecar file and loads entries of pages.
+func encryptSidecarOpen(db *DB) error {
+	if db.enc.fp != nil {
+		return nil
+	}
+	fp, err := sidecarOpen(db, GCM_SUFFIX)
+	if err != nil {
+		return fmt.Errorf("encryptSidecarOpen: %w", err)
+	}
+	db.enc.fp = fp
+
+	// pages extended but never written have no entries
+	db.enc.entries = make([]byte, db.fsize/bptree.PAGE_SIZE*GCM_ENTRY)
+	if _, err := fp.ReadAt(db.enc.entries, 0); err != nil && err != io.EOF {
+		return fmt.Errorf("encryptSidecarOpen: %w", err)
+	}
+	return nil
+}
+
+func pageNonce(ptr uint64, gen uint64) []byte {
+	nonce := make([]byte, 16)
+	binary.LittleEndian.PutUint64(nonce[0:], ptr)
+	binary.LittleEndian.PutUint64(nonce[6:], gen)
+	return nonce[:12]
+}
+
+// encryptBegin takes a new generation for the pages written by writePages. It raises the limit of generations in
+// the meta page on disk before it is reached.
+func encryptBegin(db *DB) error {
+	if db.enc.write == nil {
+		return nil
+	}
+	db.enc.gen++
+	if db.enc.gen >= GEN_MAX {
+		return errors.New("encryptBegin: generations are exhausted, use Rekey")
+	}
+	if db.enc.gen < db.enc.limit {
+		return nil
+	}
+
+	db.enc.limit = db.enc.gen + GEN_RESERVE
+	if db.fsize == 0 {
+		// nothing is committed, the limit is recorded by the first commit
+		return nil
+	}
+	// only the limit of the committed meta page is updated
+	data := bytes.Clone(pageRaw(db, 0)[:META_SIZE])
+	binary.LittleEndian.PutUint64(data[META_GEN_LIMIT:], db.enc.limit)
+	if err := fileWrite(db, 0, data); err != nil {
+		return fmt.Errorf("encryptBegin: %w", err)
+	}
+	if err := fileSync(db, db.fp); err != nil {
+		return fmt.Errorf("encryptBegin: %w", err)
+	}
+	return nil
+}
+
+// pageWrite writes a page to the file, encrypting it if necessary.
+func pageWrite(db *DB, ptr uint64, page []byte) error {
+	if db.enc.write == nil {
+		if err := fileWrite(db, int64(ptr*bptree.PAGE_SIZE), page[:bptree.PAGE_SIZE]); err != nil {
+			return fmt.Errorf("pageWrite: %w", err)
+		}
+		return nil
+	}
+
+	sealed := db.enc.write.Seal(nil, pageNonce(ptr, db.enc.gen), page[:bptree.PAGE_SIZE], nil)
+	if err := fileWrite(db, int64(ptr*bptree.PAGE_SIZE), sealed[:bptree.PAGE_SIZE]); err != nil {
+		return fmt.Errorf("pageWrite: %w", err)
+	}
+
+	if n := int(ptr+1)*GCM_ENTRY - len(db.enc.entries); n > 0 {
+		db.enc.entries = append(db.enc.entries, make([]byte, n)...)
+	}
+	entry := db.enc.entries[ptr*GCM_ENTRY:][:GCM_ENTRY]
+	binary.LittleEndian.PutUint64(entry, db.enc.gen)
+	copy(entry[8:], sealed[bptree.PAGE_SIZE:])
+	if _, err := syscall.Pwrite(int(db.enc.fp.Fd()), entry, int64(ptr*GCM_ENTRY)); err != nil {
+		return fmt.Errorf("pageWrite: %w", err)
+	}
+	return nil
+}
+
+// pageDecrypt returns the decrypted content of a mapped page, and panics with ErrCorruptPage if it fails.
+func pageDecrypt(db *DB, ptr uint64, page []byte) []byte {
+	if int(ptr+1)*GCM_ENTRY > len(db.enc.entries) {
+		panic(&ErrCorruptPage{Page: ptr, Reason: "missing encryption entry"})
+	}
+	entry := db.enc.entries[ptr*GCM_ENTRY:][:GCM_ENTRY]
+	sealed := make([]byte, bptree.PAGE_SIZE+16)
+	copy(sealed, page)
+	copy(sealed[bptree.PAGE_SIZE:], entry[8:])
+
+	plain, err := db.enc.read.Open(sealed[:0], pageNonce(ptr, binary.LittleEndian.Uint64(entry)), sealed, nil)
+	if err != nil {
+		panic(&ErrCorruptPage{Page: ptr, Reason: "authentication failed"})
+	}
+	return plain
+}
+
+// encryptSync syncs the sidecar file.
+func encryptSync(db *DB) error {
+	if db.enc.fp == nil {
+		return nil
+	}
+	return fileSync(db, db.enc.fp)
+}
+
+// Rekey rewrites every page in use with a new key in a single commit. A nil key decrypts the file, and a key for an
+// unencrypted file encrypts it.
+func (db *DB) Rekey(key []byte) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.Compress {
+		return fmt.Errorf("Rekey: encryption is %w", ErrCompressed)
+	}
+	if err := readOnly(db, "Rekey"); err != nil {
+		return err
+	}
+	if err := backupBusy(db, "Rekey"); err != nil {
+		return err
+	}
+	aead := cipher.AEAD(nil)
+	kcv := [aes.BlockSize]byte{}
+	if len(key) > 0 {
+		if aead, kcv, err = encryptCipher(key); err != nil {
+			return fmt.Errorf("Rekey: %w", err)
+		}
+		if err := encryptSidecarOpen(db); err != nil {
+			return err
+		}
+	}
+
+	meta := metaPageEncode(db)
+	write, oldKcv := db.enc.write, db.enc.kcv
+	defer func() {
+		if err != nil {
+			db.enc.write, db.enc.kcv = write, oldKcv
+			pageDiscard(db)
+			_ = metaPageDecode(db, meta)
+		}
+	}()
+	defer recoverCorrupt(db, meta, &err)
+
+	// pages on disk are read with the old key, and pages written with the new one
+	db.enc.write, db.enc.kcv = aead, kcv
+	db.tree.Rewrite()
+	db.page.flRebuild = true
+	if err := flushPages(db); err != nil {
+		return err
+	}
+
+	db.enc.read = aead
+	db.enc.encrypted = aead != nil
+	db.Key = key
+	return nil
+}
@@ -2,9 +2,15 @@ package database
 
 import (
 	"MiSQL/bptree"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"syscall"
+	"time"
 )
 
 /*
@@ -16,7 +22,55 @@ Set, Del -> updateFileSync -> writePages
 */
 
 type DB struct {
-	Path  string
+	Path string
+	// Compress stores nodes DEFLATE-compressed in extents of 512-byte sectors, see compress.go, trading CPU time for a
+	// smaller file. A file is compressed or not for its whole life, as decided when it is created.
+	Compress bool
+	// IntKeys stores keys as fixed 8-byte integers, see bptree.U64Key, for tables keyed by IDs. A new file records the
+	// layout in its meta page, and Open sets IntKeys from the meta page of an existing file.
+	IntKeys bool
+	// NoChecksum disables checksums of pages, see checksum.go.
+	NoChecksum bool
+	// FillFactor is the fraction of a page nodes are packed to when keys are appended past the last key, such as
+	// timestamps or sequences, see bptree.BPlusTree. Nodes are packed full if it is 0.
+	FillFactor float64
+	// Key is the AES key of an encrypted file, see encrypt.go. Opening a new file with a key creates it encrypted, and
+	// opening an encrypted file fails without its key. Compressed files cannot be encrypted, see ErrCompressed.
+	Key []byte
+	// PlaintextBackup allows Backup of an encrypted file, whose pages are written decrypted, see backup.go. It fails
+	// with ErrBackupEncrypted otherwise.
+	PlaintextBackup bool
+	// BufferPool replaces the mmap by a buffer pool of the amount of pages read with pread, see pool.go.
+	BufferPool int
+	// DirectIO bypasses the page cache of the kernel, caching pages in the buffer pool only, see direct.go.
+	DirectIO bool
+	// Readahead is the amount of leaves prefetched ahead of Scan, READAHEAD_LEAVES if 0, none if negative, see scan.go.
+	Readahead int
+	// NoRandomAdvice keeps the readahead of the kernel on page faults, which is disabled for point lookups otherwise.
+	NoRandomAdvice bool
+	// IOUring submits the writes and fsyncs of commits to an io_uring on Linux, see uring_linux.go.
+	IOUring bool
+	// SpillPages is the amount of pending pages of a commit kept in memory, beyond which pages spill to a scratch file,
+	// see spill.go. Pending pages are all kept in memory if it is 0.
+	SpillPages int
+	// GroupCommitSize is the most writes of concurrent Set and Del committed together, see group.go. Every write is a
+	// commit if it is 0 or 1.
+	GroupCommitSize int
+	// GroupCommitDelay is how long the first write of a group waits for the group to fill.
+	GroupCommitDelay time.Duration
+	// Observer is called on the activity of the pager, see observer.go. NopObserver is used if it is nil.
+	Observer Observer
+	// Archive appends every commit of Set and Del to log segments, see archive.go.
+	Archive bool
+	// ArchiveSegmentSize is the size segments are rotated at, ARCHIVE_SEGMENT_SIZE if 0.
+	ArchiveSegmentSize int
+	// ReadOnly opens an existing file and its sidecar files for reading only, and writes fail with ErrReadOnly. Stale
+	// checksums are not rebuilt, so pages are not verified, and the archive is not opened.
+	ReadOnly bool
+
+	// mu serializes operations, which may come from several goroutines.
+	mu    sync.Mutex
+	queue commitQueue // writes waiting for a group commit
 	fp    *os.File
 	fsize int
 	tree  bptree.BPlusTree
@@ -26,37 +80,138 @@ type DB struct {
 		chunks [][]byte // pages are stored into chunks, a chunk may contain several pages
 	}
 
+	pool   *bufferPool
+	direct []byte // aligned buffer of pages written with direct I/O
+	ring   *uring
+
+	readahead map[uint64]bool // pages advised by the current scan
+
+	spill struct {
+		fp     *os.File
+		size   int64                // end of the scratch file
+		slots  map[uint64]spillSlot // spilled pages
+		queue  []uint64             // pending pages in the order they are stored, to be spilled
+		pages  int                  // pending pages in memory
+		failed bool                 // whether the scratch file failed during the commit
+		aead   cipher.AEAD          // cipher of pages of encrypted files
+		nonce  uint64               // last nonce of sealed pages
+	}
+
 	page Page
 
 	fl FreeList
+
+	extent struct {
+		fl      [PAGE_SECTORS - 1]FreeList // freelists of extents smaller than a page, by amount of sectors
+		nFree   [PAGE_SECTORS - 1]int      // number of extents taken from each freelist
+		encoded map[uint64][]byte          // pending extents to be written, including headers
+		pad     []uint64                   // extents skipped at the end of pages, to be freed
+		codec   codec
+	}
+
+	crc struct {
+		fp       *os.File // sidecar file
+		stored   bool     // whether the sidecar file is up to date, as recorded in the meta page
+		sums     []uint32 // checksums of pages
+		verified []bool   // whether pages are verified since opened
+	}
+
+	format struct {
+		version  uint32 // version of the format of the file, see format.go
+		optional uint64 // optional features recorded in the meta page
+	}
+
+	gens struct {
+		fp     *os.File // sidecar file
+		commit uint64   // generation of the last commit
+		pages  []uint64 // generations of pages
+	}
+
+	archive struct {
+		fp      *os.File        // last segment
+		size    int64           // size of the last segment
+		pending []archiveRecord // KVs of the commit
+	}
+
+	stats struct {
+		written   uint64 // pages written
+		fsyncs    uint64
+		commits   uint64
+		readahead uint64 // pages advised ahead of scans
+		spilled   uint64 // pending pages spilled to the scratch file
+	}
+
+	backup struct {
+		pins  int      // backups in progress
+		freed []uint64 // pages freed by commits while backups are pinned
+	}
+
+	enc struct {
+		fp        *os.File    // sidecar file
+		encrypted bool        // whether the file is encrypted, as recorded in the meta page
+		read      cipher.AEAD // cipher of pages on disk
+		write     cipher.AEAD // cipher of pages written, which only differs from read during Rekey
+		kcv       [aes.BlockSize]byte
+		gen       uint64 // generation of pages being written
+		limit     uint64 // generations below the limit may have been used
+		entries   []byte // sidecar entries of pages
+	}
 }
 
 // Open (creates and) opens the database file.
 func (db *DB) Open() error {
+	if db.Observer == nil {
+		db.Observer = NopObserver{}
+	}
 	// create or open db file
-	fp, err := createFileSync(db.Path)
+	fp, err := fileOpen(db)
 	if err != nil {
 		return err // no necessary to close db file because of failing to open db file already
 	}
 	db.fp = fp
+	if db.DirectIO {
+		err = directOpen(db)
+		if err != nil {
+			goto fail
+		}
+	}
 
-	// create mmap
-	size, chunk, err := mmapInit(fp)
+	// create mmap, or the buffer pool
+	err = pagerInit(db)
 	if err != nil {
 		goto fail
 	}
-	db.fsize = size
-	db.mmap.size = len(chunk)
-	db.mmap.chunks = [][]byte{chunk}
+
+	// keep other processes out
+	err = fileLock(db)
+	if err != nil {
+		goto fail
+	}
+
+	if db.IOUring {
+		err = ringOpen(db)
+		if err != nil {
+			goto fail
+		}
+	}
 
 	// set callbacks
-	db.tree.Get = db.pageGet
+	db.tree.Get = db.nodeGet
 	db.tree.New = db.pageNew
 	db.tree.Del = db.pageDel
+	db.tree.IntKeys = db.IntKeys
+	db.tree.Prefetch = db.prefetch
+	db.tree.FillFactor = db.FillFactor
 
 	db.fl.new = db.pageAppend
 	db.fl.use = db.pageUse
-	db.fl.get = db.pageGet
+	db.fl.get = db.flnGet
+	for i := range db.extent.fl {
+		db.extent.fl[i].new = db.extentPageNew
+		db.extent.fl[i].get = db.flnGet
+	}
+	db.page.updates = make(map[uint64][]byte)
+	db.extent.encoded = make(map[uint64][]byte)
 
 	// load meta page
 	err = metaPageLoad(db)
@@ -64,6 +219,27 @@ func (db *DB) Open() error {
 		goto fail
 	}
 
+	// checksums of pages written by a commit not committed are told by their generations
+	err = generationInit(db)
+	if err != nil {
+		goto fail
+	}
+
+	err = checksumInit(db)
+	if err != nil {
+		goto fail
+	}
+
+	err = encryptInit(db)
+	if err != nil {
+		goto fail
+	}
+
+	err = archiveInit(db)
+	if err != nil {
+		goto fail
+	}
+
 	return nil
 
 fail:
@@ -72,26 +248,113 @@ fail:
 }
 
 func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	// memory unmap
 	for _, chunk := range db.mmap.chunks {
 		if err := syscall.Munmap(chunk); err != nil {
 			return fmt.Errorf("closing db file: %w", err)
 		}
 	}
+	ringClose(db)
+	spillClose(db)
 	_ = db.fp.Close()
+	if db.crc.fp != nil {
+		_ = db.crc.fp.Close()
+	}
+	if db.enc.fp != nil {
+		_ = db.enc.fp.Close()
+	}
+	if db.gens.fp != nil {
+		_ = db.gens.fp.Close()
+	}
+	if db.archive.fp != nil {
+		_ = db.archive.fp.Close()
+	}
 	return nil
 }
 
-func (db *DB) Set(key []byte, val []byte) error {
+// Get returns a copy of the value of a key, since nodes are only valid until the next commit.
+func (db *DB) Get(key []byte) (val []byte, ok bool, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverCorrupt(db, metaPageEncode(db), &err)
+	val, ok = db.tree.GetVal(key)
+	return bytes.Clone(val), ok, nil
+}
+
+var ErrReadOnly = errors.New("database is opened read-only")
+
+func (db *DB) Set(key []byte, val []byte) (err error) {
+	if err := readOnly(db, "Set"); err != nil {
+		return err
+	}
+	if len(val) > bptree.BTREE_MAX_VAL_SIZE {
+		return errors.New("Set: value too large")
+	}
+	if db.GroupCommitSize > 1 {
+		_, err := groupCommit(db, &groupWrite{op: ARCHIVE_SET, key: key, val: val})
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// a failed commit may have updated the freelist, so its pending updates are discarded
+	meta := metaPageEncode(db)
+	defer func() {
+		if err != nil {
+			pageDiscard(db)
+			_ = metaPageDecode(db, meta)
+		}
+	}()
+	defer recoverCorrupt(db, meta, &err)
+	// the key is checked against the layout of the nodes, which reads the root
+	if err := db.tree.CheckKey(key); err != nil {
+		return fmt.Errorf("Set: %w", err)
+	}
 	db.tree.Insert(key, val)
+	db.archive.pending = append(db.archive.pending, archiveRecord{op: ARCHIVE_SET, key: key, val: val})
 	return flushPages(db)
 }
 
-func (db *DB) Del(key []byte) (bool, error) {
-	ok := db.tree.Delete(key)
+func (db *DB) Del(key []byte) (ok bool, err error) {
+	if err := readOnly(db, "Del"); err != nil {
+		return false, err
+	}
+	if db.GroupCommitSize > 1 {
+		return groupCommit(db, &groupWrite{op: ARCHIVE_DEL, key: key})
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	meta := metaPageEncode(db)
+	defer func() {
+		if err != nil {
+			pageDiscard(db)
+			_ = metaPageDecode(db, meta)
+		}
+	}()
+	defer recoverCorrupt(db, meta, &err)
+	ok = db.tree.Delete(key)
+	db.archive.pending = append(db.archive.pending, archiveRecord{op: ARCHIVE_DEL, key: key})
 	return ok, flushPages(db)
 }
 
+// recoverCorrupt recovers from ErrCorruptPage raised by callbacks, which are unable to return errors. It discards
+// pending updates and restores the state of the given meta page, which is taken before the operation.
+func recoverCorrupt(db *DB, meta []byte, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	corrupt, ok := r.(*ErrCorruptPage)
+	if !ok {
+		panic(r)
+	}
+	pageDiscard(db)
+	_ = metaPageDecode(db, meta)
+	*err = corrupt
+}
+
 // deprecated, because we choose not to update root here, but update the meta page when calling syncPages().
 // updateFileSync updates database file after modification to B+ tree is done.
 //func updateFileSync(db *DB) error {
@@ -115,22 +378,85 @@ func (db *DB) Del(key []byte) (bool, error) {
 //
 //func updateRoot(db *DB) error {}
 
+var ErrLocked = errors.New("database is opened by another process")
+
+// fileLock locks the database file until it is closed: shared when it is opened read-only, and exclusive otherwise, so
+// a file is never opened for writing by two processes, nor read by a process while another one writes it.
+func fileLock(db *DB) error {
+	how := syscall.LOCK_EX
+	if db.ReadOnly {
+		how = syscall.LOCK_SH
+	}
+	err := syscall.Flock(int(db.fp.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return fmt.Errorf("fileLock: %w", ErrLocked)
+	}
+	if err != nil {
+		return fmt.Errorf("fileLock: %w", err)
+	}
+	return nil
+}
+
+// fileOpen opens the database file, which is created unless it is opened read-only.
+func fileOpen(db *DB) (*os.File, error) {
+	if db.ReadOnly {
+		return os.Open(db.Path)
+	}
+	return createFileSync(db.Path)
+}
+
+// sidecarOpen opens a sidecar file, which is created unless the database is opened read-only.
+func sidecarOpen(db *DB, suffix string) (*os.File, error) {
+	if db.ReadOnly {
+		return os.Open(db.Path + suffix)
+	}
+	return os.OpenFile(db.Path+suffix, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// readOnly returns an error for operations writing a file opened read-only.
+func readOnly(db *DB, op string) error {
+	if db.ReadOnly {
+		return fmt.Errorf("%s: %w", op, ErrReadOnly)
+	}
+	return nil
+}
+
 func createFileSync(filePath string) (*os.File, error) {
 	fp, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
-	defer func() {
-		_ = fp.Close()
-	}()
-
 	if err != nil {
 		return nil, err
 	}
 
 	if err := fp.Sync(); err != nil {
+		_ = fp.Close()
 		return nil, err
 	}
 	return fp, nil
 }
 
+// fileWrite writes data within a page of the file with pwrite, since the mmap is read-only, and updates the buffer
+// pool.
+func fileWrite(db *DB, offset int64, data []byte) error {
+	if db.DirectIO {
+		return directWrite(db, offset, data)
+	}
+	if err := filePwrite(db, data, offset); err != nil {
+		return err
+	}
+	poolWritten(db, uint64(offset/bptree.PAGE_SIZE), int(offset%bptree.PAGE_SIZE), data)
+	return nil
+}
+
+// filePwrite writes data at an offset of the file, or queues it to the io_uring during a commit, in which case data
+// must not change until the commit is synced.
+func filePwrite(db *DB, data []byte, offset int64) error {
+	if ringQueue(db, data, offset) {
+		return nil
+	}
+	_, err := syscall.Pwrite(int(db.fp.Fd()), data, offset)
+	return err
+}
+
 func fileExtend(db *DB, pageNum int) error {
 	flushedPageNum := db.fsize / bptree.PAGE_SIZE
 
@@ -156,6 +482,8 @@ func fileExtend(db *DB, pageNum int) error {
 	if err != nil {
 		return fmt.Errorf("fileExtend: %w", err)
 	}
+	db.fsize = fsize
+	db.Observer.FileExtend(fsize)
 	return nil
 
 }
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+
+On-disk format
+
+The meta page records the version of the format, the page size the file is created with, and two sets of features:
+- required features, the flags of the meta page: a file using a required feature unknown to the reader is refused,
+  since it cannot be read correctly;
+- optional features: a file using an optional feature unknown to the reader is read and written, and the feature is
+  kept recorded, since ignoring it never damages the file.
+
+Files of version 0 are created before the version is recorded, and have no optional features. Opening a file never
+writes its meta page: the next commit upgrades it, recording the current version, the optional features maintained
+from now on, and features turned on or off by options, such as checksums. So a file only opened for reading, or never
+written, keeps its meta page as it is.
+
+Version history:
+0. no version;
+1. version, page size, optional features, and the generation of the commit.
+
+*/
+
+const (
+	FORMAT_VERSION = 1
+
+	META_VERSION   = META_COMMIT + 8    // offset of the version of the format(4B)
+	META_PAGE_SIZE = META_VERSION + 4   // offset of the page size(4B)
+	META_OPTIONAL  = META_PAGE_SIZE + 4 // offset of the optional features(8B)
+
+	META_OPT_GENERATIONS = 1 << 0 // pages are tagged with commit generations, see generation.go
+
+	META_OPTIONALS = META_OPT_GENERATIONS // optional features maintained
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported file format")
+
+// formatDecode checks the version and features of a meta page.
+func formatDecode(db *DB, data []byte) error {
+	flags := binary.LittleEndian.Uint64(data[40:])
+	if flags&^META_FLAGS != 0 {
+		return fmt.Errorf("metaPageLoad: %w: unknown required features %#x", ErrUnsupportedFormat, flags&^META_FLAGS)
+	}
+	db.format.version = binary.LittleEndian.Uint32(data[META_VERSION:])
+	if db.format.version == 0 {
+		db.format.optional = 0
+		return nil
+	}
+	if pageSize := binary.LittleEndian.Uint32(data[META_PAGE_SIZE:]); pageSize != bptree.PAGE_SIZE {
+		return fmt.Errorf("metaPageLoad: %w: page size %d, expected %d", ErrUnsupportedFormat, pageSize, bptree.PAGE_SIZE)
+	}
+	db.format.optional = binary.LittleEndian.Uint64(data[META_OPTIONAL:])
+	return nil
+}
+
+// formatEncode records the version and features of a meta page.
+func formatEncode(db *DB, data []byte) {
+	binary.LittleEndian.PutUint32(data[META_VERSION:], max(db.format.version, FORMAT_VERSION))
+	binary.LittleEndian.PutUint32(data[META_PAGE_SIZE:], bptree.PAGE_SIZE)
+	binary.LittleEndian.PutUint64(data[META_OPTIONAL:], db.format.optional|META_OPTIONALS)
+}
@@ -3,6 +3,8 @@ package database
 import (
 	"MiSQL/bptree"
 	"encoding/binary"
+	"errors"
+	"fmt"
 )
 
 const (
@@ -26,6 +28,9 @@ type FreeList struct {
 }
 
 func (fl *FreeList) NumPage() int {
+	if fl.head == 0 {
+		return 0
+	}
 	node := fl.get(fl.head)
 	return int(binary.LittleEndian.Uint64(node[4:]))
 }
@@ -47,56 +52,152 @@ func (fl *FreeList) Update(nFreePagesRequired int, pagesFreed []uint64) {
 		return
 	}
 
-	nPage := fl.NumPage()
-	ptrReuse := []uint64{} // reused pointers to free pages during operation
+	nodes, remain, nPage := flPop(fl, nFreePagesRequired)
+	flPush(fl, append(pagesFreed, nodes...), remain, nPage)
+}
 
-	for fl.head != 0 && len(ptrReuse)*FLNODE_CAP < len(pagesFreed) { //
+// flPop removes used pointers from the top of the freelist.
+// Freelist nodes are copy-on-write like B+ tree nodes, so the freelist referenced by the current meta page is left
+// intact. It returns pointers of the popped nodes, the unused pointers in them to be pushed back, and the amount of
+// pointers left in the freelist.
+// Unlike the popped nodes, pages of the unused pointers are not referenced by the current meta page, so they can be
+// reused by the new nodes. The total amount stored in a node always counts the node and the nodes below it.
+func flPop(fl *FreeList, nFreePagesRequired int) ([]uint64, []uint64, int) {
+	nPage := fl.NumPage()
+	nodes := []uint64{}
+	remain := []uint64{}
+	for fl.head != 0 && nFreePagesRequired > 0 {
 		node := fl.get(fl.head)
-		pagesFreed = append(pagesFreed, fl.head)
+		nodes = append(nodes, fl.head)
 
-		if nFreePagesRequired >= flnSize(node) {
-			nFreePagesRequired -= flnSize(node)
+		size := flnSize(node)
+		if nFreePagesRequired >= size {
+			nFreePagesRequired -= size
 		} else {
-			nRemain := flnSize(node) - nFreePagesRequired
+			// pointers at the top are used, the rest of them are pushed back
+			for i := 0; i < size-nFreePagesRequired; i++ {
+				remain = append(remain, flnPtr(node, i))
+			}
 			nFreePagesRequired = 0
+		}
 
-			for nRemain > 0 && len(ptrReuse)*FLNODE_CAP < len(pagesFreed)+nRemain {
-				nRemain--
-				ptrReuse = append(ptrReuse, flnPtr(node, nRemain))
-			}
+		nPage -= size
+		fl.head = flnNext(node)
+	}
+	return nodes, remain, nPage
+}
+
+// flPush pushes freed pointers and reusable pointers onto the freelist with new nodes, given the amount of pointers
+// already in it. New nodes are stored in pages of reusable pointers first.
+func flPush(fl *FreeList, ptrFreed []uint64, ptrReuse []uint64, nPage int) {
+	for len(ptrFreed)+len(ptrReuse) > 0 {
+		// do not reuse the last pointer for an empty node
+		reuse := len(ptrReuse) > 0 && len(ptrFreed)+len(ptrReuse) > 1
+		ptr := uint64(0)
+		if reuse {
+			ptr, ptrReuse = ptrReuse[len(ptrReuse)-1], ptrReuse[:len(ptrReuse)-1]
+		}
 
-			for i := 0; i < nRemain; i++ {
-				pagesFreed = append(pagesFreed, flnPtr(node, i))
+		node := make(bptree.Node, bptree.PAGE_SIZE)
+		size := len(ptrFreed) + len(ptrReuse)
+		if size > FLNODE_CAP {
+			size = FLNODE_CAP
+		}
+		flnSetHeader(node, uint16(size), fl.head)
+		for i := 0; i < size; i++ {
+			if len(ptrFreed) > 0 {
+				flnSetPtr(node, i, ptrFreed[0])
+				ptrFreed = ptrFreed[1:]
+			} else {
+				flnSetPtr(node, i, ptrReuse[0])
+				ptrReuse = ptrReuse[1:]
 			}
 		}
+		nPage += size
+		flnSetNumNodes(node, uint64(nPage))
 
-		nPage -= flnSize(node)
-		fl.head = flnNext(node)
+		if reuse {
+			fl.use(ptr, node)
+			fl.head = ptr
+		} else {
+			fl.head = fl.new(node)
+		}
 	}
-	flPush(fl, pagesFreed, ptrReuse)
-	flnSetNumNodes(fl.get(fl.head), uint64(nPage+len(pagesFreed)))
-
 }
 
-func flPush(fl *FreeList, ptrFreed []uint64, ptrReuse []uint64) {
-
+// flRebuild is Update that rewrites the whole freelist with new nodes, so no node of the old freelist is referenced
+// afterward.
+func flRebuild(fl *FreeList, nFreePagesRequired int, pagesFreed []uint64) {
+	for ptr := fl.head; ptr != 0; {
+		node := fl.get(ptr)
+		pagesFreed = append(pagesFreed, ptr)
+		// skip pointers used from the top
+		for i := flnSize(node) - 1; i >= 0; i-- {
+			if nFreePagesRequired > 0 {
+				nFreePagesRequired--
+				continue
+			}
+			pagesFreed = append(pagesFreed, flnPtr(node, i))
+		}
+		ptr = flnNext(node)
+	}
+	fl.head = 0
+	flPush(fl, pagesFreed, nil, 0)
 }
 
 /* callbacks for freelists */
 
+// flnGet is pageGet validating freelist nodes read from disk, and panics with ErrCorruptPage if they are malformed.
+func (db *DB) flnGet(ptr uint64) bptree.Node {
+	node := db.pageGet(ptr)
+	if _, ok := db.page.updates[ptr]; !ok {
+		if err := flnValidate(db, node); err != nil {
+			panic(&ErrCorruptPage{Page: pageOf(db, ptr), Reason: err.Error()})
+		}
+	}
+	return node
+}
+
 func (db *DB) pageAppend(node bptree.Node) uint64 {
+	if db.Compress {
+		// freelist nodes are stored raw
+		ptr := extentAppend(db, PAGE_SECTORS)
+		pageStore(db, ptr, node, node)
+		return ptr
+	}
+
 	ptr := db.page.nFlushed + db.page.nAppend
 	db.page.nAppend++
-	db.page.updates[ptr] = node
+	pageStore(db, ptr, node, nil)
 	return ptr
 }
 
 func (db *DB) pageUse(ptr uint64, node bptree.Node) {
-	db.page.updates[ptr] = node
+	pageStore(db, ptr, node, node)
 }
 
 /* end callbacks */
 
+// flnValidate checks the structure of a freelist node read from disk, and whether its pointers are in range.
+func flnValidate(db *DB, node bptree.Node) error {
+	if len(node) < bptree.PAGE_SIZE || binary.LittleEndian.Uint16(node[0:]) != FLNODE {
+		return errors.New("bad freelist node type")
+	}
+	size := flnSize(node)
+	if size > FLNODE_CAP || uint64(size) > binary.LittleEndian.Uint64(node[4:]) {
+		return fmt.Errorf("bad freelist node size %d", size)
+	}
+	if next := flnNext(node); next != 0 && !ptrFlushed(db, next, db.page.nFlushed) {
+		return fmt.Errorf("next freelist node %d out of range", next)
+	}
+	for i := 0; i < size; i++ {
+		if !ptrFlushed(db, flnPtr(node, i), db.page.nFlushed) {
+			return fmt.Errorf("freed pointer %d out of range", flnPtr(node, i))
+		}
+	}
+	return nil
+}
+
 // flnSize returns amount of pointers in a freelist node.
 func flnSize(node bptree.Node) int {
 	return int(binary.LittleEndian.Uint16(node[2:]))
@@ -121,12 +222,17 @@ func flnSetPtr(node bptree.Node, idx int, ptr uint64) {
 
 // flnSetHeader sets the header of a freelist node with the size and pointer to next node.
 func flnSetHeader(node bptree.Node, size uint16, next uint64) {
-	binary.LittleEndian.PutUint64(node[0:], FLNODE)
+	binary.LittleEndian.PutUint16(node[0:], FLNODE)
 	binary.LittleEndian.PutUint16(node[2:], size)
 	binary.LittleEndian.PutUint64(node[12:], next)
 }
 
+// flnNumNodes returns number of total items in the freelist.
+func flnNumNodes(node bptree.Node) uint64 {
+	return binary.LittleEndian.Uint64(node[4:])
+}
+
 // flnSetNumNodes sets number of total items in the freelist.
 func flnSetNumNodes(node bptree.Node, numNodes uint64) {
-	binary.LittleEndian.Uint64(node[4:])
+	binary.LittleEndian.PutUint64(node[4:], numNodes)
 }
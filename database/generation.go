@@ -0,0 +1,99 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+/*
+
+Commit generations
+
+Every commit has a generation, which is recorded in the meta page and increases by one with each commit. Every page
+is tagged with the generation of the commit writing it, in a sidecar file next to the database file:
+Path+GEN_SUFFIX: generation of page 0(8B) - generation of page 1(8B) - ...
+
+Every page written by a commit is tagged with its generation, including pages holding live extents whose free sectors
+get new extents with DB.Compress, so a page reachable from a commit with a generation not greater than the generation
+of an earlier commit is unchanged since then, and was reachable from the earlier commit as well. This is how
+BackupSince tells pages changed since a backup. Tags are synced with the pages, before the meta page is updated, and
+before pages holding live extents are rewritten, so a page tagged with a generation above the commit of the meta page
+is written by a commit not committed, see checksumInit.
+
+Pages of a file without the sidecar file, or not recording generations as an optional feature, are tagged with the
+generation of the last commit, as if they were just written.
+
+*/
+
+const GEN_SUFFIX = ".gen"
+
+// generationInit opens the sidecar file and loads generations of pages.
+func generationInit(db *DB) error {
+	_, err := os.Stat(db.Path + GEN_SUFFIX)
+	// files not maintaining generations may have written pages without tagging them
+	missing := os.IsNotExist(err) || db.format.optional&META_OPT_GENERATIONS == 0
+	nPage := db.fsize / bptree.PAGE_SIZE
+	data := make([]byte, 8*nPage)
+	if missing {
+		for i := 0; i < nPage; i++ {
+			binary.LittleEndian.PutUint64(data[8*i:], db.gens.commit)
+		}
+	}
+	// a file opened read-only keeps the generations of a missing sidecar in memory
+	if !missing || !db.ReadOnly {
+		fp, err := sidecarOpen(db, GEN_SUFFIX)
+		if err != nil {
+			return fmt.Errorf("generationInit: %w", err)
+		}
+		db.gens.fp = fp
+		if missing {
+			if _, err := syscall.Pwrite(int(fp.Fd()), data, 0); err != nil {
+				return fmt.Errorf("generationInit: %w", err)
+			}
+			if err := fp.Sync(); err != nil {
+				return fmt.Errorf("generationInit: %w", err)
+			}
+		} else if _, err := fp.ReadAt(data, 0); err != nil && err != io.EOF {
+			return fmt.Errorf("generationInit: %w", err)
+		}
+	}
+
+	db.gens.pages = make([]uint64, nPage)
+	for i := range db.gens.pages {
+		db.gens.pages[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+	return nil
+}
+
+// generationUpdate tags the pages written by writePages with the generation of the commit.
+func generationUpdate(db *DB) error {
+	if n := db.fsize/bptree.PAGE_SIZE - len(db.gens.pages); n > 0 {
+		db.gens.pages = append(db.gens.pages, make([]uint64, n)...)
+	}
+
+	data := [8]byte{}
+	binary.LittleEndian.PutUint64(data[:], db.gens.commit+1)
+	for ptr := range pagesWritten(db) {
+		db.gens.pages[ptr] = db.gens.commit + 1
+		if _, err := syscall.Pwrite(int(db.gens.fp.Fd()), data[:], int64(8*ptr)); err != nil {
+			return fmt.Errorf("generationUpdate: %w", err)
+		}
+	}
+	return nil
+}
+
+// generationSync syncs the sidecar file.
+func generationSync(db *DB) error {
+	return fileSync(db, db.gens.fp)
+}
+
+// Generation returns the generation of the last commit.
+func (db *DB) Generation() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.gens.commit
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+
+Group commit
+
+Every Set and Del is a commit paying the fsyncs of syncPages. With DB.GroupCommitSize, writes of concurrent callers are
+queued in groups of at most the amount, and every group is a single commit. The first writer of a group leads it: it
+waits up to DB.GroupCommitDelay for the group to fill, then for the lock of the database, while the group still takes
+writes, so writers arriving during a commit are committed together by the next one. The leader applies the writes of
+the group in order, commits them, and wakes up the other writers.
+
+Every writer gets the result of its own Del, its own rejected key, and the error of the commit, which is the same for
+every write of the group. Writes of a group are archived with the generation and the time of the commit, see archive.go.
+
+*/
+
+// groupWrite is a Set or a Del waiting in a group.
+type groupWrite struct {
+	op       byte // ARCHIVE_SET or ARCHIVE_DEL
+	key, val []byte
+	ok       bool  // result of Del
+	err      error // a key rejected by Set, which is not applied
+}
+
+// commitGroup is the writes committed together.
+type commitGroup struct {
+	writes []*groupWrite
+	full   chan struct{} // closed when the group reaches DB.GroupCommitSize
+	done   chan struct{} // closed when the group is committed
+	err    error
+}
+
+// commitQueue holds the group taking writes.
+type commitQueue struct {
+	mu   sync.Mutex
+	open *commitGroup
+}
+
+// groupCommit queues a write in the open group, and returns the result of the write once the group is committed.
+func groupCommit(db *DB, w *groupWrite) (bool, error) {
+	q := &db.queue
+	q.mu.Lock()
+	g := q.open
+	leader := g == nil
+	if leader {
+		g = &commitGroup{full: make(chan struct{}), done: make(chan struct{})}
+		q.open = g
+	}
+	g.writes = append(g.writes, w)
+	if len(g.writes) >= db.GroupCommitSize {
+		// later writes go to the next group
+		q.open = nil
+		close(g.full)
+	}
+	q.mu.Unlock()
+
+	if !leader {
+		<-g.done
+		return w.ok, errors.Join(w.err, g.err)
+	}
+
+	if db.GroupCommitDelay > 0 {
+		timer := time.NewTimer(db.GroupCommitDelay)
+		select {
+		case <-g.full:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	db.mu.Lock()
+	q.mu.Lock()
+	if q.open == g {
+		q.open = nil
+	}
+	q.mu.Unlock()
+	g.err = groupApply(db, g.writes)
+	db.mu.Unlock()
+	close(g.done)
+	return w.ok, errors.Join(w.err, g.err)
+}
+
+// groupApply applies the writes of a group to the tree, and commits them. A failed commit rolls back the whole group.
+func groupApply(db *DB, writes []*groupWrite) (err error) {
+	meta := metaPageEncode(db)
+	defer func() {
+		if err != nil {
+			pageDiscard(db)
+			_ = metaPageDecode(db, meta)
+			for _, w := range writes {
+				w.ok = false
+			}
+		}
+	}()
+	defer recoverCorrupt(db, meta, &err)
+	for _, w := range writes {
+		if w.op == ARCHIVE_SET {
+			if err := db.tree.CheckKey(w.key); err != nil {
+				w.err = fmt.Errorf("Set: %w", err)
+				continue
+			}
+			db.tree.Insert(w.key, w.val)
+		} else {
+			w.ok = db.tree.Delete(w.key)
+		}
+		db.archive.pending = append(db.archive.pending, archiveRecord{op: w.op, key: w.key, val: w.val})
+	}
+	return flushPages(db)
+}
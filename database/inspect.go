@@ -0,0 +1,339 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+/*
+
+Inspection
+
+The meta page, single pages, the freelists and the B+ tree are exposed as they are stored, for debugging damaged files,
+see misql inspect. Pages are decoded by their type tags, BNODE_* and FLNODE, or by EXTENT_MAGIC for compressed extents,
+without trusting the structure of the file.
+
+*/
+
+// INSPECT_BYTES is the amount of bytes of keys and values shown by String methods.
+const INSPECT_BYTES = 32
+
+// MetaInfo is the content of the committed meta page.
+type MetaInfo struct {
+	Version  uint32
+	PageSize uint32
+	Flags    uint64 // required features
+	Optional uint64 // optional features
+	Root     uint64
+	Flushed  uint64 // flushed pages, or sectors with compression
+	FreeList uint64 // head of the freelist of pages
+	Extents  [PAGE_SECTORS - 1]uint64
+	GenLimit uint64 // limit of encryption generations
+	Commit   uint64 // generation of the commit
+	FileSize int
+	NumPages int
+	Mmap     int // mapped bytes
+	Chunks   int // mmap chunks
+}
+
+func (m *MetaInfo) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "version: %d\n", m.Version)
+	fmt.Fprintf(&b, "page size: %d\n", m.PageSize)
+	fmt.Fprintf(&b, "required features: %#x %v\n", m.Flags, featureNames(m.Flags, map[uint64]string{
+		META_FLAG_INT_KEYS: "int keys", META_FLAG_COMPRESS: "compress", META_FLAG_CHECKSUM: "checksum",
+		META_FLAG_ENCRYPT: "encrypt",
+	}))
+	fmt.Fprintf(&b, "optional features: %#x %v\n", m.Optional, featureNames(m.Optional, map[uint64]string{
+		META_OPT_GENERATIONS: "generations",
+	}))
+	fmt.Fprintf(&b, "root: %d\n", m.Root)
+	fmt.Fprintf(&b, "flushed: %d\n", m.Flushed)
+	fmt.Fprintf(&b, "freelist: %d\n", m.FreeList)
+	if m.Flags&META_FLAG_COMPRESS != 0 {
+		for i, head := range m.Extents {
+			fmt.Fprintf(&b, "freelist of %d sectors: %d\n", i+1, head)
+		}
+	}
+	if m.Flags&META_FLAG_ENCRYPT != 0 {
+		fmt.Fprintf(&b, "generation limit: %d\n", m.GenLimit)
+	}
+	fmt.Fprintf(&b, "commit: %d\n", m.Commit)
+	fmt.Fprintf(&b, "file: %d bytes, %d pages, %d bytes mapped in %d chunks\n", m.FileSize, m.NumPages, m.Mmap, m.Chunks)
+	return b.String()
+}
+
+// featureNames names the features set in bits, and shows unknown ones in hex.
+func featureNames(bits uint64, names map[uint64]string) []string {
+	list := []string{}
+	for bit := uint64(1); bit != 0; bit <<= 1 {
+		if bits&bit == 0 {
+			continue
+		}
+		if name, ok := names[bit]; ok {
+			list = append(list, name)
+		} else {
+			list = append(list, fmt.Sprintf("unknown %#x", bit))
+		}
+	}
+	return list
+}
+
+// InspectMeta returns the content of the committed meta page.
+func (db *DB) InspectMeta() *MetaInfo {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return inspectMeta(db)
+}
+
+func inspectMeta(db *DB) *MetaInfo {
+	m := &MetaInfo{FileSize: db.fsize, NumPages: db.fsize / bptree.PAGE_SIZE, Mmap: db.mmap.size, Chunks: len(db.mmap.chunks)}
+	if db.fsize == 0 {
+		return m
+	}
+	data := pageRaw(db, 0)
+	m.Version = binary.LittleEndian.Uint32(data[META_VERSION:])
+	m.PageSize = binary.LittleEndian.Uint32(data[META_PAGE_SIZE:])
+	m.Flags = binary.LittleEndian.Uint64(data[40:])
+	m.Optional = binary.LittleEndian.Uint64(data[META_OPTIONAL:])
+	m.Root = binary.LittleEndian.Uint64(data[16:])
+	m.Flushed = binary.LittleEndian.Uint64(data[24:])
+	m.FreeList = binary.LittleEndian.Uint64(data[32:])
+	for i := range m.Extents {
+		m.Extents[i] = binary.LittleEndian.Uint64(data[48+8*i:])
+	}
+	m.GenLimit = binary.LittleEndian.Uint64(data[META_GEN_LIMIT:])
+	m.Commit = binary.LittleEndian.Uint64(data[META_COMMIT:])
+	return m
+}
+
+// PageInfo is a page decoded by InspectPage.
+type PageInfo struct {
+	Page    uint64
+	Kind    string     // meta, internal, leaf, freelist, extents, zero or unknown
+	Nodes   []NodeInfo // the node of the page, or the nodes of its extents
+	Meta    *MetaInfo  // the content of the meta page
+	Problem string     // why the page is not decoded
+	raw     []byte
+}
+
+// NodeInfo is a B+ tree node or a freelist node.
+type NodeInfo struct {
+	Ptr     uint64
+	Node    bptree.Node
+	Problem string // why the node is not valid
+}
+
+// Kind returns the kind of the node by its type tag.
+func (n *NodeInfo) Kind() string {
+	switch binary.LittleEndian.Uint16(n.Node) &^ bptree.BNODE_INT_KEYS {
+	case bptree.BNODE_INTERNAL:
+		return "internal"
+	case bptree.BNODE_LEAF:
+		return "leaf"
+	case FLNODE:
+		return "freelist"
+	}
+	return "unknown"
+}
+
+func (p *PageInfo) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "page %d: %s\n", p.Page, p.Kind)
+	if p.Meta != nil {
+		b.WriteString(p.Meta.String())
+	}
+	if p.Problem != "" {
+		fmt.Fprintf(&b, "problem: %s\n", p.Problem)
+	}
+	if p.Kind == "unknown" && p.raw != nil {
+		fmt.Fprintf(&b, "head: % x\n", p.raw[:64])
+	}
+	for i := range p.Nodes {
+		b.WriteString(p.Nodes[i].String())
+	}
+	return b.String()
+}
+
+func (n *NodeInfo) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "node %d: %s\n", n.Ptr, n.Kind())
+	if n.Problem != "" {
+		fmt.Fprintf(&b, "  problem: %s\n", n.Problem)
+		return b.String()
+	}
+	node := n.Node
+	if n.Kind() == "freelist" {
+		fmt.Fprintf(&b, "  size %d, total %d, next %d\n", flnSize(node), flnNumNodes(node), flnNext(node))
+		for i := 0; i < flnSize(node); i++ {
+			fmt.Fprintf(&b, "  %d\n", flnPtr(node, i))
+		}
+		return b.String()
+	}
+	layout := "bytes"
+	if node.Layout() == bptree.BNODE_INT_KEYS {
+		layout = "int"
+	}
+	fmt.Fprintf(&b, "  %s keys, %d keys, %d bytes\n", layout, node.NumKeys(), node.Size())
+	for i := uint16(0); i < node.NumKeys(); i++ {
+		if node.Type() == bptree.BNODE_INTERNAL {
+			fmt.Fprintf(&b, "  %q -> %d\n", inspectBytes(node.Key(i)), node.Ptr(i))
+		} else {
+			fmt.Fprintf(&b, "  %q = %q\n", inspectBytes(node.Key(i)), inspectBytes(node.Val(i)))
+		}
+	}
+	return b.String()
+}
+
+// inspectBytes truncates bytes to INSPECT_BYTES.
+func inspectBytes(data []byte) string {
+	if len(data) > INSPECT_BYTES {
+		return string(data[:INSPECT_BYTES]) + "..."
+	}
+	return string(data)
+}
+
+// inspectNode decodes a node by its type tag.
+func inspectNode(ptr uint64, node bptree.Node) NodeInfo {
+	info := NodeInfo{Ptr: ptr, Node: node}
+	switch info.Kind() {
+	case "internal", "leaf":
+		if err := node.Validate(); err != nil {
+			info.Problem = err.Error()
+		}
+	case "freelist":
+		if flnSize(node) > FLNODE_CAP {
+			info.Problem = fmt.Sprintf("size %d exceeds the capacity", flnSize(node))
+		}
+	}
+	return info
+}
+
+// InspectPage decodes a page, or the extents of a page with compression. Pointers of extents are found from their
+// content, which may be smaller than the extents.
+func (db *DB) InspectPage(page uint64) (info *PageInfo, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	info = &PageInfo{Page: page}
+	if page == 0 {
+		info.Kind, info.Meta = "meta", inspectMeta(db)
+		return info, nil
+	}
+	if page >= uint64(db.fsize/bptree.PAGE_SIZE) {
+		return nil, fmt.Errorf("InspectPage: page %d is beyond the file", page)
+	}
+
+	// damaged pages are shown as they are mapped
+	defer func() {
+		if r := recover(); r != nil {
+			corrupt, ok := r.(*ErrCorruptPage)
+			if !ok {
+				panic(r)
+			}
+			info.Kind, info.Problem, info.raw = "unknown", corrupt.Reason, bytes.Clone(pageRaw(db, page))
+		}
+	}()
+	data := pageGetMapped(db, page)
+	info.raw = data
+
+	ptr := page
+	if db.Compress {
+		ptr = extentPtr(page*PAGE_SECTORS, PAGE_SECTORS)
+	}
+	if !db.Compress || binary.LittleEndian.Uint16(data) != EXTENT_MAGIC {
+		node := inspectNode(ptr, data)
+		info.Kind = node.Kind()
+		if info.Kind == "unknown" {
+			if strings.Count(string(data), "\x00") == len(data) {
+				info.Kind = "zero"
+			}
+			return info, nil
+		}
+		info.Nodes = append(info.Nodes, node)
+		return info, nil
+	}
+
+	// compressed extents start with the magic at sector boundaries
+	info.Kind = "extents"
+	for sector := uint64(0); sector < PAGE_SECTORS; sector++ {
+		extent := data[sector*SECTOR_SIZE:]
+		if binary.LittleEndian.Uint16(extent) != EXTENT_MAGIC {
+			continue
+		}
+		nSector := (EXTENT_HEADER + int(binary.LittleEndian.Uint16(extent[2:])) + SECTOR_SIZE - 1) / SECTOR_SIZE
+		if int(sector)+nSector > PAGE_SECTORS {
+			continue
+		}
+		ptr := extentPtr(page*PAGE_SECTORS+sector, nSector)
+		node, err := db.extent.codec.decompress(extent[:nSector*SECTOR_SIZE])
+		if err != nil {
+			info.Nodes = append(info.Nodes, NodeInfo{Ptr: ptr, Node: make(bptree.Node, bptree.PAGE_SIZE), Problem: err.Error()})
+			continue
+		}
+		info.Nodes = append(info.Nodes, inspectNode(ptr, node))
+		sector += uint64(nSector) - 1
+	}
+	return info, nil
+}
+
+// FreeListInfo is a freelist listed by InspectFreeLists.
+type FreeListInfo struct {
+	Sectors int      // amount of sectors of free extents, or PAGE_SECTORS for pages
+	Nodes   []uint64 // freelist nodes from the head
+	Items   []uint64 // free pages or extents
+}
+
+// InspectFreeLists lists the freelist of pages, and the freelists of extents with compression.
+func (db *DB) InspectFreeLists() (lists []FreeListInfo, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverCorrupt(db, metaPageEncode(db), &err)
+
+	fls := []*FreeList{&db.fl}
+	if db.Compress {
+		for i := range db.extent.fl {
+			fls = append(fls, &db.extent.fl[i])
+		}
+	}
+	for i, fl := range fls {
+		list := FreeListInfo{Sectors: PAGE_SECTORS}
+		if i > 0 {
+			list.Sectors = i
+		}
+		for ptr := fl.head; ptr != 0; {
+			node := fl.get(ptr)
+			list.Nodes = append(list.Nodes, ptr)
+			for j := 0; j < flnSize(node); j++ {
+				list.Items = append(list.Items, flnPtr(node, j))
+			}
+			ptr = flnNext(node)
+		}
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
+
+// InspectTree visits the nodes of the B+ tree depth first, with the pointers of their parents, 0 for the root.
+func (db *DB) InspectTree(visit func(ptr uint64, parent uint64, depth int, node bptree.Node)) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverCorrupt(db, metaPageEncode(db), &err)
+
+	var walk func(ptr uint64, parent uint64, depth int)
+	walk = func(ptr uint64, parent uint64, depth int) {
+		node := db.tree.Get(ptr)
+		visit(ptr, parent, depth, node)
+		if node.Type() == bptree.BNODE_INTERNAL {
+			for i := uint16(0); i < node.NumKeys(); i++ {
+				walk(node.Ptr(i), ptr, depth+1)
+			}
+		}
+	}
+	if db.tree.Root != 0 {
+		walk(db.tree.Root, 0, 0)
+	}
+	return nil
+}
@@ -8,6 +8,16 @@ import (
 	"syscall"
 )
 
+/*
+
+Read-only mmap
+
+The file is mapped PROT_READ, and every write goes through fileWrite with pwrite, so a stray write into a page returned
+by the mmap, such as a Node, faults instead of reaching the file. The mmap only needs to cover pages read, so writePages
+extends it after writing pages, and the mapping of a chunk is never written through.
+
+*/
+
 // mmapInit initializes mmap and returns the size, chunks of the mmap.
 func mmapInit(fp *os.File) (int, []byte, error) {
 	fi, err := fp.Stat()
@@ -27,7 +37,7 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 		mmapSize *= 2
 	}
 
-	chunk, err := syscall.Mmap(int(fp.Fd()), 0, mmapSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	chunk, err := syscall.Mmap(int(fp.Fd()), 0, mmapSize, syscall.PROT_READ, syscall.MAP_SHARED)
 	if err != nil {
 		return 0, nil, fmt.Errorf("mmap: %w", err)
 	}
@@ -35,18 +45,34 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 
 }
 
+// mmapOpen maps the file.
+func mmapOpen(db *DB) error {
+	size, chunk, err := mmapInit(db.fp)
+	if err != nil {
+		return err
+	}
+	db.fsize = size
+	db.mmap.size = len(chunk)
+	db.mmap.chunks = [][]byte{chunk}
+	mmapAdvise(db, chunk)
+	return nil
+}
+
 // mmapExtend extends memory map when necessary.
 func mmapExtend(db *DB, numPage int) error {
-	if db.mmap.size >= numPage*bptree.PAGE_SIZE {
+	if db.pool != nil {
 		return nil
 	}
-
 	// double the address space of mmap by appending new chunk with the same size as the existing total chunks
-	chunk, err := syscall.Mmap(int(db.fp.Fd()), int64(db.mmap.size), db.mmap.size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+	for db.mmap.size < numPage*bptree.PAGE_SIZE {
+		chunk, err := syscall.Mmap(int(db.fp.Fd()), int64(db.mmap.size), db.mmap.size, syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+		db.mmap.size += db.mmap.size
+		db.mmap.chunks = append(db.mmap.chunks, chunk)
+		mmapAdvise(db, chunk)
+		db.Observer.MmapExtend(db.mmap.size)
 	}
-	db.mmap.size += db.mmap.size
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
 	return nil
 }
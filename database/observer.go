@@ -0,0 +1,112 @@
+package database
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/*
+
+Observers
+
+DB.Observer is called on the activity of the pager: commits, fsyncs, pages allocated and freed by commits, extensions
+of the file and of the mmap, and reads of flushed pages. Calls are made with the lock of the database held, so they
+must be fast and must not call the database. NopObserver is used if DB.Observer is nil.
+
+PrometheusObserver counts the activity, and serves the counters in the Prometheus text format as an http.Handler,
+which the caller mounts on its own server. An observer may be shared by several databases.
+
+*/
+
+// Observer is called on the activity of the pager.
+type Observer interface {
+	CommitStart()
+	CommitEnd(d time.Duration, err error)
+	Fsync(d time.Duration)
+	PageAlloc(ptr uint64) // a page, or an extent with compression, is written by a commit
+	PageFree(ptr uint64)  // a page, or an extent with compression, is freed by a commit
+	FileExtend(size int)
+	MmapExtend(size int)
+	PageRead(page uint64) // a flushed page is read from the mmap
+}
+
+// NopObserver ignores the activity.
+type NopObserver struct{}
+
+func (NopObserver) CommitStart()                         {}
+func (NopObserver) CommitEnd(d time.Duration, err error) {}
+func (NopObserver) Fsync(d time.Duration)                {}
+func (NopObserver) PageAlloc(ptr uint64)                 {}
+func (NopObserver) PageFree(ptr uint64)                  {}
+func (NopObserver) FileExtend(size int)                  {}
+func (NopObserver) MmapExtend(size int)                  {}
+func (NopObserver) PageRead(page uint64)                 {}
+
+// PrometheusObserver counts the activity, and serves the counters in the Prometheus text format.
+type PrometheusObserver struct {
+	commits      atomic.Uint64
+	commitErrors atomic.Uint64
+	commitNanos  atomic.Uint64
+	fsyncs       atomic.Uint64
+	fsyncNanos   atomic.Uint64
+	allocs       atomic.Uint64
+	frees        atomic.Uint64
+	fileExtends  atomic.Uint64
+	fileSize     atomic.Int64
+	mmapExtends  atomic.Uint64
+	mmapSize     atomic.Int64
+	reads        atomic.Uint64
+}
+
+func (o *PrometheusObserver) CommitStart() {}
+
+func (o *PrometheusObserver) CommitEnd(d time.Duration, err error) {
+	o.commits.Add(1)
+	o.commitNanos.Add(uint64(d))
+	if err != nil {
+		o.commitErrors.Add(1)
+	}
+}
+
+func (o *PrometheusObserver) Fsync(d time.Duration) {
+	o.fsyncs.Add(1)
+	o.fsyncNanos.Add(uint64(d))
+}
+
+func (o *PrometheusObserver) PageAlloc(ptr uint64) { o.allocs.Add(1) }
+func (o *PrometheusObserver) PageFree(ptr uint64)  { o.frees.Add(1) }
+func (o *PrometheusObserver) PageRead(page uint64) { o.reads.Add(1) }
+
+func (o *PrometheusObserver) FileExtend(size int) {
+	o.fileExtends.Add(1)
+	o.fileSize.Store(int64(size))
+}
+
+func (o *PrometheusObserver) MmapExtend(size int) {
+	o.mmapExtends.Add(1)
+	o.mmapSize.Store(int64(size))
+}
+
+// ServeHTTP writes the counters in the Prometheus text format.
+func (o *PrometheusObserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name string, kind string, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	seconds := func(nanos uint64) float64 { return time.Duration(nanos).Seconds() }
+
+	metric("misql_commits_total", "counter", "Commits, including failed ones.", o.commits.Load())
+	metric("misql_commit_errors_total", "counter", "Failed commits.", o.commitErrors.Load())
+	metric("misql_commit_seconds_total", "counter", "Time spent in commits.", seconds(o.commitNanos.Load()))
+	metric("misql_fsyncs_total", "counter", "Fsyncs of database files and sidecar files.", o.fsyncs.Load())
+	metric("misql_fsync_seconds_total", "counter", "Time spent in fsyncs.", seconds(o.fsyncNanos.Load()))
+	metric("misql_pages_allocated_total", "counter", "Pages or extents written by commits.", o.allocs.Load())
+	metric("misql_pages_freed_total", "counter", "Pages or extents freed by commits.", o.frees.Load())
+	metric("misql_page_reads_total", "counter", "Reads of flushed pages.", o.reads.Load())
+	metric("misql_file_extensions_total", "counter", "Extensions of database files.", o.fileExtends.Load())
+	metric("misql_file_size_bytes", "gauge", "Size of the last extended database file.", o.fileSize.Load())
+	metric("misql_mmap_extensions_total", "counter", "Extensions of mmaps.", o.mmapExtends.Load())
+	metric("misql_mmap_size_bytes", "gauge", "Size of the last extended mmap.", o.mmapSize.Load())
+}
@@ -3,19 +3,40 @@ package database
 import (
 	"MiSQL/bptree"
 	"bytes"
+	"crypto/aes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"syscall"
+	"time"
 )
 
-const DB_SIG = "MiSQLMasterPage"
+const (
+	DB_SIG = "MiSQLMasterPage"
+
+	META_FLAG_INT_KEYS = 1 << 0 // nodes store fixed 8-byte integer keys, see bptree.BNODE_INT_KEYS
+	META_FLAG_COMPRESS = 1 << 1 // nodes are stored in compressed extents
+	META_FLAG_CHECKSUM = 1 << 2 // checksums of pages are maintained
+	META_FLAG_ENCRYPT  = 1 << 3 // pages are encrypted
+
+	META_GEN_LIMIT = 48 + 8*(PAGE_SECTORS-1)  // offset of the limit of generations
+	META_KCV       = META_GEN_LIMIT + 8       // offset of the key check value
+	META_COMMIT    = META_KCV + aes.BlockSize // offset of the generation of the commit
+
+	META_FLAGS = META_FLAG_INT_KEYS | META_FLAG_COMPRESS | META_FLAG_CHECKSUM | META_FLAG_ENCRYPT // known flags, see format.go
+
+	META_SIZE = META_OPTIONAL + 8
+)
 
 type Page struct {
-	nFlushed uint64            // db size in number of pages
+	nFlushed uint64            // db size in number of pages, or sectors with compression
 	nFree    int               // number of pages taken from freelist
 	nAppend  uint64            // number of temporary pages to be appended
 	updates  map[uint64][]byte // pending updates, including appending pages
+
+	flRebuild bool // rewrite every freelist node in the next writePages
+
+	deferred []uint64 // pages freed while backups are pinned, see backupDefer
+	released bool     // whether pages kept aside by backups are freed
 }
 
 // pageGet obtains a page given with its pointer by checking in memory map. It serves as the callback function for
@@ -23,15 +44,70 @@ type Page struct {
 func (db *DB) pageGet(ptr uint64) bptree.Node {
 	// if this page is temporarily stored and not flushed into disk
 	if page, ok := db.page.updates[ptr]; ok {
+		if pageSpilled(page) {
+			return spillGet(db, ptr)
+		}
 		return page
 	}
 
 	// else this page is in disk
+	if !ptrFlushed(db, ptr, db.page.nFlushed) {
+		panic(&ErrCorruptPage{Page: pageOf(db, ptr), Reason: fmt.Sprintf("pointer %d out of range", ptr)})
+	}
+	if db.Compress {
+		return extentGetMapped(db, ptr)
+	}
 	return pageGetMapped(db, ptr)
 
 }
 
+// nodeGet is pageGet validating B+ tree nodes read from disk, and panics with ErrCorruptPage if they are malformed.
+// It serves as the callback function for BP tree.
+func (db *DB) nodeGet(ptr uint64) bptree.Node {
+	node := db.pageGet(ptr)
+	if _, ok := db.page.updates[ptr]; !ok {
+		if err := node.Validate(); err != nil {
+			panic(&ErrCorruptPage{Page: pageOf(db, ptr), Reason: err.Error()})
+		}
+	}
+	return node
+}
+
+// ptrFlushed checks whether a pointer refers to a page, or an extent with compression, in the flushed pages other
+// than the meta page.
+func ptrFlushed(db *DB, ptr uint64, nFlushed uint64) bool {
+	if !db.Compress {
+		return ptr != 0 && ptr < nFlushed
+	}
+	sector, size := extentSector(ptr), uint64(extentSize(ptr))
+	return sector >= PAGE_SECTORS && sector+size <= nFlushed && sector%PAGE_SECTORS+size <= PAGE_SECTORS
+}
+
+// pageOf returns the page number of a pointer.
+func pageOf(db *DB, ptr uint64) uint64 {
+	if db.Compress {
+		return extentSector(ptr) / PAGE_SECTORS
+	}
+	return ptr
+}
+
+// pageGetMapped returns a flushed page, verifying its checksum on its first read.
 func pageGetMapped(db *DB, ptr uint64) []byte {
+	page := pageRaw(db, ptr)
+	if page != nil {
+		db.Observer.PageRead(ptr)
+		checksumVerify(db, ptr, page)
+		if db.enc.read != nil && ptr != 0 {
+			page = pageDecrypt(db, ptr, page)
+		} else if db.pool != nil {
+			page = bytes.Clone(page) // the frame is replaced by later reads
+		}
+	}
+	return page
+}
+
+// mmapPage returns the mapped bytes of a page, or nil if the page is not mapped.
+func mmapPage(db *DB, ptr uint64) []byte {
 	start := uint64(0)
 	for _, chunk := range db.mmap.chunks {
 		end := start + uint64(len(chunk))/bptree.PAGE_SIZE
@@ -46,6 +122,10 @@ func pageGetMapped(db *DB, ptr uint64) []byte {
 
 /* callbacks for BP tree */
 func (db *DB) pageNew(node bptree.Node) uint64 {
+	if db.Compress {
+		return extentNew(db, node)
+	}
+
 	ptr := uint64(0)
 	if db.page.nFree < db.fl.NumPage() {
 		// there are still page unused in the freelist, then use them instead of appending new pages
@@ -56,17 +136,24 @@ func (db *DB) pageNew(node bptree.Node) uint64 {
 		ptr = db.page.nAppend + db.page.nFlushed
 		db.page.nAppend++
 	}
-	db.page.updates[ptr] = node
+	pageStore(db, ptr, node, nil)
 	return ptr
 }
 
 func (db *DB) pageDel(ptr uint64) {
+	pageForget(db, ptr)
 	db.page.updates[ptr] = nil
 }
 
 /* ends callbacks */
 
-func flushPages(db *DB) error {
+func flushPages(db *DB) (err error) {
+	if err := readOnly(db, "flushPages"); err != nil {
+		return err
+	}
+	db.Observer.CommitStart()
+	defer func(start time.Time) { db.Observer.CommitEnd(time.Since(start), err) }(time.Now())
+	defer ringEnd(db)
 	if err := writePages(db); err != nil {
 		return err
 	}
@@ -74,6 +161,10 @@ func flushPages(db *DB) error {
 }
 
 func writePages(db *DB) error {
+	if err := encryptBegin(db); err != nil {
+		return err
+	}
+
 	// update freelist first
 	freed := []uint64{}
 	for ptr, page := range db.page.updates {
@@ -81,36 +172,120 @@ func writePages(db *DB) error {
 			freed = append(freed, ptr)
 		}
 	}
-	db.fl.Update(db.page.nFree, freed)
+	freed = backupDefer(db, freed)
+	if db.Compress {
+		// freelist nodes appended while updating freelists may skip sectors as well, which are freed by another
+		// update, and an aligned append never skips sectors again
+		freed = append(freed, db.extent.pad...)
+		db.extent.pad = nil
+		extentFreeListUpdate(db, freed)
+		for len(db.extent.pad) > 0 {
+			pad := db.extent.pad
+			db.extent.pad = nil
+			extentFreeListUpdate(db, pad)
+		}
+	} else if db.page.flRebuild {
+		flRebuild(&db.fl, db.page.nFree, freed)
+	} else {
+		db.fl.Update(db.page.nFree, freed)
+	}
 
 	// check if it's necessary to extend file or mmap
-	numPage := int(db.page.nFlushed) + len(db.page.updates)
+	numPage := int(db.page.nFlushed + db.page.nAppend)
+	if db.Compress {
+		numPage = (numPage + PAGE_SECTORS - 1) / PAGE_SECTORS
+	}
 	if err := fileExtend(db, numPage); err != nil {
 		return err
 	}
+
+	// pages holding live extents are tagged before they are rewritten, see checksum.go
+	if err := generationUpdate(db); err != nil {
+		return err
+	}
+	if pagesRewritten(db) {
+		if err := generationSync(db); err != nil {
+			return err
+		}
+	}
+
+	// flush updates to disks, queued until syncPages with io_uring
+	ringBegin(db)
+	for ptr, page := range db.page.updates {
+		if page == nil {
+			db.Observer.PageFree(ptr)
+			continue
+		}
+		db.Observer.PageAlloc(ptr)
+		data := page
+		if db.Compress {
+			data = db.extent.encoded[ptr]
+		}
+		if pageSpilled(page) {
+			var err error
+			if data, err = spillRead(db, ptr); err != nil {
+				return err
+			}
+		}
+		if db.Compress {
+			err := fileWrite(db, int64(extentSector(ptr)*SECTOR_SIZE), data)
+			if err != nil {
+				return fmt.Errorf("writePages: %w", err)
+			}
+		} else if err := pageWrite(db, ptr, data); err != nil {
+			return err
+		}
+	}
+
+	// the written pages are read through the mmap afterward
 	if err := mmapExtend(db, numPage); err != nil {
 		return err
 	}
 
-	// flush updates to disks
+	db.stats.written += uint64(len(pagesWritten(db)))
+	return checksumUpdate(db)
+}
+
+// pagesWritten returns the pages written by writePages.
+func pagesWritten(db *DB) map[uint64]bool {
+	written := map[uint64]bool{}
 	for ptr, page := range db.page.updates {
 		if page != nil {
-			copy(pageGetMapped(db, ptr), page)
+			written[pageOf(db, ptr)] = true
 		}
 	}
+	return written
+}
 
-	return nil
+// pagesRewritten returns whether writePages rewrites pages holding live extents, which is only done with compression.
+func pagesRewritten(db *DB) bool {
+	if !db.Compress {
+		return false
+	}
+	flushed := (db.page.nFlushed + PAGE_SECTORS - 1) / PAGE_SECTORS
+	for page := range pagesWritten(db) {
+		if page < flushed {
+			return true
+		}
+	}
+	return false
 }
 
 func syncPages(db *DB) error {
-	// sync written pages
-	if err := db.fp.Sync(); err != nil {
+	// sync written pages, and the archived KVs of the commit
+	if err := pagesSync(db); err != nil {
+		return err
+	}
+	if err := archiveAppend(db); err != nil {
 		return err
 	}
 
 	// discard buffers
-	db.page.nFlushed += uint64(len(db.page.updates))
-	db.page.updates = make(map[uint64][]byte)
+	db.page.nFlushed += db.page.nAppend
+	db.gens.commit++
+	db.stats.commits++
+	backupCommit(db)
+	pageDiscard(db)
 
 	// update meta page
 	if err := metaPageUpdate(db); err != nil {
@@ -118,56 +293,162 @@ func syncPages(db *DB) error {
 	}
 
 	// sync updated meta page
-	if err := db.fp.Sync(); err != nil {
+	if db.ring != nil {
+		return ringSync(db, db.fp)
+	}
+	if err := fileSync(db, db.fp); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// pagesSync syncs the pages written by a commit, and sidecar files.
+func pagesSync(db *DB) error {
+	if db.ring != nil {
+		return ringSync(db, db.fp, db.crc.fp, db.enc.fp, db.gens.fp)
+	}
+	if err := fileSync(db, db.fp); err != nil {
+		return err
+	}
+	if err := checksumSync(db); err != nil {
+		return err
+	}
+	if err := encryptSync(db); err != nil {
+		return err
+	}
+	return generationSync(db)
+}
+
+// pageDiscard discards pending updates.
+func pageDiscard(db *DB) {
+	db.page.nAppend = 0
+	db.page.nFree = 0
+	db.page.updates = make(map[uint64][]byte)
+	db.extent.nFree = [PAGE_SECTORS - 1]int{}
+	db.extent.encoded = make(map[uint64][]byte)
+	db.extent.pad = nil
+	db.page.flRebuild = false
+	db.page.deferred = nil
+	db.page.released = false
+	db.archive.pending = nil
+	spillDiscard(db)
+}
+
 // Meta page is the first page to store pointers to root pages and other important stuff.
 // Structure of meta page:
-// Signature(16B), BP tree root pointer(8B), number of flushed pages(8B), freelist head root pointer(8B)
+// Signature(16B), BP tree root pointer(8B), number of flushed pages(8B), freelist head root pointer(8B), flags(8B),
+// extent freelist head pointers((PAGE_SECTORS-1)*8B), limit of generations(8B), key check value(16B),
+// generation of the commit(8B), version(4B), page size(4B), optional features(8B)
 
 // metaPageLoad checks meta page and updates BP tree root pointers and page amount.
 func metaPageLoad(db *DB) error {
 	if db.fsize == 0 { // empty db file
 		db.page.nFlushed = 1
+		if db.Compress {
+			db.page.nFlushed = PAGE_SECTORS
+		}
 		return nil
 	}
 
-	data := db.mmap.chunks[0]
-	root := binary.LittleEndian.Uint64(data[16:])
-	pageUsedNum := binary.LittleEndian.Uint64(data[24:])
-	flHead := binary.LittleEndian.Uint64(data[32:])
-
-	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
-		return errors.New("metaPageLoad: bad signature")
+	if err := metaPageDecode(db, pageRaw(db, 0)); err != nil {
+		return err
 	}
 
-	bad := !(pageUsedNum >= 1 && pageUsedNum < uint64(db.fsize/bptree.PAGE_SIZE))
+	unit := uint64(1)
+	if db.Compress {
+		unit = PAGE_SECTORS
+	}
+	pageUsedNum := db.page.nFlushed
+	bad := !(pageUsedNum >= unit && pageUsedNum <= uint64(db.fsize/bptree.PAGE_SIZE)*unit)
 	if bad {
 		return errors.New("metaPageLoad: bad meta")
 	}
 
-	db.tree.Root = root
-	db.page.nFlushed = pageUsedNum
-	db.fl.head = flHead
+	// pointers are checked against flushed pages before being read
+	heads := []uint64{db.tree.Root, db.fl.head}
+	for i := range db.extent.fl {
+		heads = append(heads, db.extent.fl[i].head)
+	}
+	for _, ptr := range heads {
+		if ptr != 0 && !ptrFlushed(db, ptr, pageUsedNum) {
+			return fmt.Errorf("metaPageLoad: pointer %d out of range", ptr)
+		}
+	}
 	return nil
 }
 
-// metaPageUpdate gets the pointer of BP tree root node and flushed page amount from the memory,
-// and updates them in the meta page.
-func metaPageUpdate(db *DB) error {
-	data := [32]byte{}
+// metaPageDecode updates BP tree root pointers and page amount from a meta page.
+func metaPageDecode(db *DB, data []byte) error {
+	if len(data) < META_SIZE {
+		return errors.New("metaPageLoad: meta page is too short")
+	}
+	sig := [16]byte{}
+	copy(sig[:], DB_SIG)
+	if !bytes.Equal(sig[:], data[:16]) {
+		return errors.New("metaPageLoad: bad signature")
+	}
+
+	if err := formatDecode(db, data); err != nil {
+		return err
+	}
+	flags := binary.LittleEndian.Uint64(data[40:])
+	// the mode and the layout of an existing file are decided by the file
+	db.Compress = flags&META_FLAG_COMPRESS != 0
+	db.IntKeys = flags&META_FLAG_INT_KEYS != 0
+	db.tree.IntKeys = db.IntKeys
+	db.crc.stored = flags&META_FLAG_CHECKSUM != 0
+	db.enc.encrypted = flags&META_FLAG_ENCRYPT != 0
+	copy(db.enc.kcv[:], data[META_KCV:])
+	db.gens.commit = binary.LittleEndian.Uint64(data[META_COMMIT:])
+	// the limit never decreases, since generations below it may have been used
+	db.enc.limit = max(db.enc.limit, binary.LittleEndian.Uint64(data[META_GEN_LIMIT:]))
+
+	db.tree.Root = binary.LittleEndian.Uint64(data[16:])
+	db.page.nFlushed = binary.LittleEndian.Uint64(data[24:])
+	db.fl.head = binary.LittleEndian.Uint64(data[32:])
+	for i := range db.extent.fl {
+		db.extent.fl[i].head = binary.LittleEndian.Uint64(data[48+8*i:])
+	}
+	return nil
+}
+
+// metaPageEncode returns the meta page for BP tree root pointers and page amount in the memory.
+func metaPageEncode(db *DB) []byte {
+	data := make([]byte, META_SIZE)
 	copy(data[:16], []byte(DB_SIG))
 
+	flags := uint64(0)
+	if db.Compress {
+		flags |= META_FLAG_COMPRESS
+	}
+	if db.tree.IntKeys {
+		flags |= META_FLAG_INT_KEYS
+	}
+	if db.crc.stored {
+		flags |= META_FLAG_CHECKSUM
+	}
+	if db.enc.write != nil {
+		flags |= META_FLAG_ENCRYPT
+		copy(data[META_KCV:], db.enc.kcv[:])
+	}
+	binary.LittleEndian.PutUint64(data[META_GEN_LIMIT:], db.enc.limit)
+	binary.LittleEndian.PutUint64(data[META_COMMIT:], db.gens.commit)
 	binary.LittleEndian.PutUint64(data[16:], db.tree.Root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.nFlushed)
 	binary.LittleEndian.PutUint64(data[32:], db.fl.head)
+	binary.LittleEndian.PutUint64(data[40:], flags)
+	for i := range db.extent.fl {
+		binary.LittleEndian.PutUint64(data[48+8*i:], db.extent.fl[i].head)
+	}
+	formatEncode(db, data)
+	return data
+}
 
-	_, err := syscall.Pwrite(int(db.fp.Fd()), data[:], 0)
-	if err != nil {
+// metaPageUpdate gets the pointer of BP tree root node and flushed page amount from the memory,
+// and updates them in the meta page.
+func metaPageUpdate(db *DB) error {
+	if err := fileWrite(db, 0, metaPageEncode(db)); err != nil {
 		return fmt.Errorf("metaPageUpdate: %w", err)
 	}
 
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"fmt"
+	"io"
+)
+
+/*
+
+Buffer pool
+
+With DB.BufferPool, the file is not mapped: pages are read with pread into a pool of DB.BufferPool frames, and the
+memory used is bounded by the pool. Writes go through fileWrite with pwrite, which updates cached frames, so a stray
+write into a frame never reaches the file, but is read back until the frame is replaced.
+
+Frames are replaced by the CLOCK algorithm: a frame read since the hand last passed it gets a second chance. A frame
+returned by pageRaw is only valid until the next page is read, so nodes are copied out of their frames, since the B+
+tree keeps nodes along its paths. So an operation reading more pages than the pool holds, such as Check, replaces
+frames as it goes, and the pool never holds more than DB.BufferPool frames.
+
+Pages are verified against their checksums again when they are read back after being replaced.
+
+*/
+
+// bufferPool caches pages read with pread.
+type bufferPool struct {
+	capacity int
+	frames   []poolFrame
+	index    map[uint64]int // frames by page
+	hand     int            // CLOCK hand
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type poolFrame struct {
+	page uint64
+	data []byte
+	used bool // whether the frame holds a page
+	ref  bool // whether the frame is read since the hand passed it
+}
+
+// pagerInit maps the file, or sets up the buffer pool.
+func pagerInit(db *DB) error {
+	capacity := db.BufferPool
+	if capacity <= 0 && db.DirectIO {
+		capacity = DIRECT_POOL_PAGES
+	}
+	if capacity <= 0 {
+		return mmapOpen(db)
+	}
+	fi, err := db.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("pagerInit: %w", err)
+	}
+	if fi.Size()%bptree.PAGE_SIZE != 0 {
+		return fmt.Errorf("pagerInit: file size %d is not a multiple of page size", fi.Size())
+	}
+	db.fsize = int(fi.Size())
+	db.pool = &bufferPool{capacity: capacity, index: map[uint64]int{}}
+	return nil
+}
+
+// pageRaw returns the bytes of a page on disk, or nil if the page is beyond the mmap. Pages returned by the buffer
+// pool are only valid until the next page is read.
+func pageRaw(db *DB, ptr uint64) []byte {
+	if db.pool == nil {
+		return mmapPage(db, ptr)
+	}
+	return db.pool.frames[poolPage(db, ptr)].data
+}
+
+// poolPage returns the frame holding a page, reading it on a miss.
+func poolPage(db *DB, page uint64) int {
+	p := db.pool
+	i, ok := p.index[page]
+	if ok {
+		p.hits++
+	} else {
+		p.misses++
+		i = poolVictim(p)
+		f := &p.frames[i]
+		if f.data == nil {
+			f.data = alignedBuf(bptree.PAGE_SIZE) // for direct I/O
+		}
+		// pages extended but never written read as zeros
+		n, err := db.fp.ReadAt(f.data, int64(page*bptree.PAGE_SIZE))
+		if err != nil && err != io.EOF {
+			panic(&ErrCorruptPage{Page: page, Reason: err.Error()})
+		}
+		clear(f.data[n:])
+		f.page, f.used = page, true
+		p.index[page] = i
+		if page < uint64(len(db.crc.verified)) {
+			db.crc.verified[page] = false
+		}
+	}
+	p.frames[i].ref = true
+	return i
+}
+
+// poolVictim returns a frame to hold a page, replacing a page if the pool is full.
+func poolVictim(p *bufferPool) int {
+	if len(p.frames) < p.capacity {
+		p.frames = append(p.frames, poolFrame{})
+		return len(p.frames) - 1
+	}
+	for {
+		i := p.hand
+		p.hand = (p.hand + 1) % len(p.frames)
+		f := &p.frames[i]
+		if !f.used {
+			return i
+		}
+		if f.ref {
+			f.ref = false
+			continue
+		}
+		delete(p.index, f.page)
+		f.used = false
+		p.evictions++
+		return i
+	}
+}
+
+// poolWritten updates a cached page written to the file without the pool.
+func poolWritten(db *DB, page uint64, offset int, data []byte) {
+	if db.pool == nil {
+		return
+	}
+	if i, ok := db.pool.index[page]; ok {
+		copy(db.pool.frames[i].data[offset:], data)
+	}
+}
+
+// poolTruncate drops cached pages beyond a truncated file.
+func poolTruncate(db *DB, nPage uint64) {
+	if db.pool == nil {
+		return
+	}
+	for i := range db.pool.frames {
+		if f := &db.pool.frames[i]; f.used && f.page >= nPage {
+			delete(db.pool.index, f.page)
+			f.used = false
+		}
+	}
+}
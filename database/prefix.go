@@ -0,0 +1,133 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+
+Space usage by key prefix
+
+SpaceByPrefix walks the leaves and attributes the bytes every KV takes in its leaf to the bucket of its key: its
+pointer, offset, KV header, key and value. Values are stored in leaves, there are no overflow pages, so the bytes of the
+leaves not attributed are headers of nodes and free space within nodes.
+
+*/
+
+// PrefixOptions chooses the bucket of a key: the key up to and including the first Delimiter, or its first Length
+// bytes if Delimiter is empty. A key without the delimiter, or shorter than Length, is a bucket by itself.
+type PrefixOptions struct {
+	Length    int
+	Delimiter []byte
+}
+
+// prefix returns the bucket of a key.
+func (o *PrefixOptions) prefix(key []byte) []byte {
+	if len(o.Delimiter) > 0 {
+		if i := bytes.Index(key, o.Delimiter); i >= 0 {
+			return key[:i+len(o.Delimiter)]
+		}
+		return key
+	}
+	return key[:min(len(key), o.Length)]
+}
+
+// PrefixUsage is the space taken by the keys of a bucket.
+type PrefixUsage struct {
+	Prefix   string
+	Keys     int
+	KeyBytes int64
+	ValBytes int64
+	Bytes    int64   // bytes taken in leaves, including pointers, offsets and KV headers
+	Share    float64 // share of the bytes of all the buckets
+}
+
+// PrefixReport is the result of SpaceByPrefix.
+type PrefixReport struct {
+	Buckets   []PrefixUsage // by bytes, the largest first
+	Bytes     int64         // bytes taken by KVs in leaves
+	LeafBytes int64         // bytes of leaf pages
+}
+
+func (r *PrefixReport) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%-24s %10s %12s %12s %12s %7s\n", "PREFIX", "KEYS", "KEY BYTES", "VAL BYTES", "BYTES", "SHARE")
+	for _, u := range r.Buckets {
+		fmt.Fprintf(&b, "%-24q %10d %12d %12d %12d %6.2f%%\n", u.Prefix, u.Keys, u.KeyBytes, u.ValBytes, u.Bytes, 100*u.Share)
+	}
+	fmt.Fprintf(&b, "%d bytes of KVs in %d bytes of leaves\n", r.Bytes, r.LeafBytes)
+	return b.String()
+}
+
+// SpaceByPrefix attributes the bytes of leaves to buckets of key prefixes.
+func (db *DB) SpaceByPrefix(opts PrefixOptions) (r *PrefixReport, err error) {
+	if len(opts.Delimiter) == 0 && opts.Length <= 0 {
+		return nil, errors.New("SpaceByPrefix: either a delimiter or a positive length is needed")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverCorrupt(db, metaPageEncode(db), &err)
+
+	r = &PrefixReport{}
+	buckets := map[string]*PrefixUsage{}
+	dummy := true
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node := db.tree.Get(ptr)
+		if node.Type() == bptree.BNODE_INTERNAL {
+			for i := uint16(0); i < node.NumKeys(); i++ {
+				walk(node.Ptr(i))
+			}
+			return
+		}
+		r.LeafBytes += bptree.PAGE_SIZE
+		// the KV header of the int layout holds the key
+		header := int64(4)
+		if node.Layout() == bptree.BNODE_INT_KEYS {
+			header = 10
+		}
+		for i := uint16(0); i < node.NumKeys(); i++ {
+			key, val := node.Key(i), node.Val(i)
+			if dummy {
+				dummy = false // the first key of the leftmost leaf
+				continue
+			}
+			u := buckets[string(opts.prefix(key))]
+			if u == nil {
+				u = &PrefixUsage{Prefix: string(opts.prefix(key))}
+				buckets[u.Prefix] = u
+			}
+			u.Keys++
+			u.KeyBytes += int64(len(key))
+			u.ValBytes += int64(len(val))
+			u.Bytes += 8 + 2 + header + int64(len(val))
+			if node.Layout() != bptree.BNODE_INT_KEYS {
+				u.Bytes += int64(len(key))
+			}
+		}
+	}
+	if db.tree.Root != 0 {
+		walk(db.tree.Root)
+	}
+
+	for _, u := range buckets {
+		r.Bytes += u.Bytes
+		r.Buckets = append(r.Buckets, *u)
+	}
+	for i := range r.Buckets {
+		r.Buckets[i].Share = float64(r.Buckets[i].Bytes) / float64(r.Bytes)
+	}
+	sort.Slice(r.Buckets, func(i, j int) bool {
+		a, b := r.Buckets[i], r.Buckets[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Prefix < b.Prefix
+	})
+	return r, nil
+}
@@ -0,0 +1,358 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+/*
+
+Salvage
+
+Salvage recovers KVs from a file whose meta page or internal nodes are damaged. It never trusts the structure of the
+file: every page is scanned for leaf nodes, raw or in compressed extents, that pass the validation.
+
+Copy-on-write leaves old versions of leaves behind, so a key may be found in several leaves. The newest version is
+guessed by ranking leaves, from the most to the least trusted:
+1. leaves reachable from the root of the meta page, if it is readable;
+2. leaves neither reachable nor free, which are under damaged internal nodes;
+3. leaves in the freelists, which are old versions.
+Leaves of the same rank are ordered by the generation of encrypted pages, then by the page number, since files grow
+by appending.
+
+A reachable leaf holds every key of its range in the tree, so a key found in other leaves only, whose range is covered
+by a valid reachable leaf, is deleted, and is skipped. Keys whose range has no valid reachable leaf, since internal
+nodes or the leaf are damaged, are written, and counted in SalvageReport.Unreachable, since deleted keys may come back
+among them from old leaves.
+
+*/
+
+const (
+	SALVAGE_FREE = iota
+	SALVAGE_UNKNOWN
+	SALVAGE_REACHABLE
+)
+
+// SalvageReport is the result of Salvage.
+type SalvageReport struct {
+	Pages    int  // pages scanned
+	Meta     bool // whether the meta page is readable
+	Leaves   int  // valid leaf nodes found
+	Versions int  // KVs found, including old versions
+	Keys     int  // keys written
+	// Deleted is the keys skipped, since a reachable leaf covering them lacks them.
+	Deleted int
+	// Unreachable is the keys written from leaves not reachable only, which may be deleted keys coming back.
+	Unreachable int
+}
+
+func (r *SalvageReport) String() string {
+	return fmt.Sprintf("pages: %d\nmeta: %v\nleaves: %d\nversions: %d\nkeys: %d\ndeleted: %d\nunreachable: %d\n",
+		r.Pages, r.Meta, r.Leaves, r.Versions, r.Keys, r.Deleted, r.Unreachable)
+}
+
+// salvager reads pages of a damaged file without trusting its structure.
+type salvager struct {
+	fp      *os.File
+	nPage   uint64
+	db      DB             // holds the state decoded from the meta page, the cipher and the codec
+	ranks   map[uint64]int // ranks of leaves by position, see position
+	visited map[uint64]bool
+	covered []salvageRange // key ranges of valid reachable leaves, in key order
+}
+
+// salvageRange is the key range of a reachable leaf in the tree.
+type salvageRange struct {
+	lo, hi []byte // hi is nil past the last key
+}
+
+// salvageLeaf is a leaf node found by the scan.
+type salvageLeaf struct {
+	node bptree.Node
+	rank int
+	gen  uint64
+	page uint64
+}
+
+// Salvage scans every page of a damaged file for leaf nodes, and writes their KVs into an opened database. The
+// damaged file is read only, and key is needed if it is encrypted.
+func Salvage(path string, key []byte, dst *DB) (*SalvageReport, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Salvage: %w", err)
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Salvage: %w", err)
+	}
+
+	s := salvager{fp: fp, nPage: uint64(fi.Size()) / bptree.PAGE_SIZE, ranks: map[uint64]int{}, visited: map[uint64]bool{}}
+	report := &SalvageReport{Pages: int(s.nPage)}
+	meta := s.readRaw(0)
+	report.Meta = meta != nil && metaPageDecode(&s.db, meta) == nil
+	if err := s.decryptInit(path, key, report.Meta); err != nil {
+		return nil, err
+	}
+	if report.Meta {
+		s.rankTree()
+		s.rankFreeLists()
+	}
+
+	leaves := s.scan()
+	report.Leaves = len(leaves)
+	sort.SliceStable(leaves, func(i, j int) bool {
+		a, b := leaves[i], leaves[j]
+		if a.rank != b.rank {
+			return a.rank < b.rank
+		}
+		if a.gen != b.gen {
+			return a.gen < b.gen
+		}
+		return a.page < b.page
+	})
+
+	// newer versions overwrite older ones
+	kvs, reachable := map[string][]byte{}, map[string]bool{}
+	for _, leaf := range leaves {
+		for i := uint16(0); i < leaf.node.NumKeys(); i++ {
+			if i == 0 && salvageLeftmost(leaf.node) {
+				continue // the dummy key
+			}
+			k, v := leaf.node.Key(i), leaf.node.Val(i)
+			kvs[string(k)] = v
+			reachable[string(k)] = leaf.rank == SALVAGE_REACHABLE
+			report.Versions++
+		}
+	}
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		switch {
+		case reachable[k]:
+		case s.covers([]byte(k)):
+			report.Deleted++
+			continue
+		default:
+			report.Unreachable++
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := dst.Set([]byte(k), kvs[k]); err != nil {
+			return report, fmt.Errorf("Salvage: %w", err)
+		}
+		report.Keys++
+	}
+	return report, nil
+}
+
+// decryptInit sets up decryption of pages, checking the key against the meta page if it is readable.
+func (s *salvager) decryptInit(path string, key []byte, meta bool) error {
+	if len(key) == 0 {
+		if meta && s.db.enc.encrypted {
+			return errors.New("Salvage: file is encrypted, but no key is given")
+		}
+		return nil
+	}
+	aead, kcv, err := encryptCipher(key)
+	if err != nil {
+		return fmt.Errorf("Salvage: %w", err)
+	}
+	if meta && s.db.enc.encrypted && kcv != s.db.enc.kcv {
+		return ErrWrongKey
+	}
+	entries, err := os.ReadFile(path + GCM_SUFFIX)
+	if err != nil {
+		return fmt.Errorf("Salvage: %w", err)
+	}
+	s.db.enc.read, s.db.enc.entries = aead, entries
+	return nil
+}
+
+// readRaw reads a page from the file, or returns nil if it cannot.
+func (s *salvager) readRaw(page uint64) []byte {
+	data := make([]byte, bptree.PAGE_SIZE)
+	if _, err := s.fp.ReadAt(data, int64(page*bptree.PAGE_SIZE)); err != nil && err != io.EOF {
+		return nil
+	}
+	return data
+}
+
+// readPage reads and decrypts a page, or returns nil if it cannot.
+func (s *salvager) readPage(page uint64) (data []byte) {
+	data = s.readRaw(page)
+	if data == nil || s.db.enc.read == nil {
+		return data
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*ErrCorruptPage); !ok {
+				panic(r)
+			}
+			data = nil
+		}
+	}()
+	return pageDecrypt(&s.db, page, data)
+}
+
+// node reads a B+ tree node given with its pointer, or returns nil if it is not valid.
+func (s *salvager) node(ptr uint64) bptree.Node {
+	if !ptrFlushed(&s.db, ptr, s.db.page.nFlushed) {
+		return nil
+	}
+	page := s.readPage(pageOf(&s.db, ptr))
+	if page == nil {
+		return nil
+	}
+	node := bptree.Node(page)
+	if s.db.Compress {
+		begin := extentSector(ptr) % PAGE_SECTORS * SECTOR_SIZE
+		var err error
+		if node, err = s.db.extent.codec.decompress(page[begin : begin+uint64(extentSize(ptr))*SECTOR_SIZE]); err != nil {
+			return nil
+		}
+	}
+	if node.Validate() != nil {
+		return nil
+	}
+	return node
+}
+
+// position returns the page, or the first sector of an extent, of a pointer. Extents are known by their first sector,
+// since they may be larger than their content.
+func (s *salvager) position(ptr uint64) uint64 {
+	if s.db.Compress {
+		return extentSector(ptr)
+	}
+	return ptr
+}
+
+// rankTree ranks leaves reachable from the root, and records their key ranges.
+func (s *salvager) rankTree() {
+	var walk func(ptr uint64, lo, hi []byte)
+	walk = func(ptr uint64, lo, hi []byte) {
+		if s.visited[ptr] {
+			return
+		}
+		s.visited[ptr] = true
+		node := s.node(ptr)
+		if node == nil {
+			return
+		}
+		if node.Type() == bptree.BNODE_LEAF {
+			s.ranks[s.position(ptr)] = SALVAGE_REACHABLE
+			s.covered = append(s.covered, salvageRange{lo: lo, hi: hi})
+			return
+		}
+		for i := uint16(0); i < node.NumKeys(); i++ {
+			kidLo, kidHi := node.Key(i), hi
+			if i == 0 {
+				kidLo = lo
+			}
+			if i+1 < node.NumKeys() {
+				kidHi = node.Key(i + 1)
+			}
+			walk(node.Ptr(i), kidLo, kidHi)
+		}
+	}
+	if s.db.tree.Root != 0 {
+		walk(s.db.tree.Root, []byte{}, nil)
+	}
+}
+
+// covers returns whether the key is in the range of a valid reachable leaf.
+func (s *salvager) covers(key []byte) bool {
+	i := sort.Search(len(s.covered), func(i int) bool { return bytes.Compare(s.covered[i].lo, key) > 0 })
+	if i == 0 {
+		return false
+	}
+	r := s.covered[i-1]
+	return r.hi == nil || bytes.Compare(key, r.hi) < 0
+}
+
+// rankFreeLists ranks leaves in the freelists as old versions.
+func (s *salvager) rankFreeLists() {
+	heads := []uint64{s.db.fl.head}
+	for i := range s.db.extent.fl {
+		heads = append(heads, s.db.extent.fl[i].head)
+	}
+	for _, ptr := range heads {
+		for ptr != 0 && !s.visited[ptr] && ptrFlushed(&s.db, ptr, s.db.page.nFlushed) {
+			s.visited[ptr] = true
+			node := s.readPage(pageOf(&s.db, ptr))
+			if node == nil || binary.LittleEndian.Uint16(node) != FLNODE || flnSize(node) > FLNODE_CAP {
+				break
+			}
+			for i := 0; i < flnSize(node); i++ {
+				if _, ok := s.ranks[s.position(flnPtr(node, i))]; !ok {
+					s.ranks[s.position(flnPtr(node, i))] = SALVAGE_FREE
+				}
+			}
+			ptr = flnNext(node)
+		}
+	}
+}
+
+// salvageLeftmost returns whether a leaf is a version of the leftmost leaf of the tree, which starts with the dummy key.
+// The dummy key is the least key of its layout, and is never a key of the user, see bptree.CheckKey.
+func salvageLeftmost(leaf bptree.Node) bool {
+	if leaf.Layout() == bptree.BNODE_INT_KEYS {
+		return binary.BigEndian.Uint64(leaf.Key(0)) == 0
+	}
+	return len(leaf.Key(0)) == 0
+}
+
+// scan finds every valid leaf node, raw or in compressed extents.
+func (s *salvager) scan() []salvageLeaf {
+	leaves := []salvageLeaf{}
+	add := func(ptr uint64, page uint64, node bptree.Node) {
+		if node.Validate() != nil || node.Type() != bptree.BNODE_LEAF {
+			return
+		}
+		rank, ok := s.ranks[s.position(ptr)]
+		if !ok {
+			rank = SALVAGE_UNKNOWN
+		}
+		gen := uint64(0)
+		if s.db.enc.read != nil {
+			gen = binary.LittleEndian.Uint64(s.db.enc.entries[page*GCM_ENTRY:])
+		}
+		leaves = append(leaves, salvageLeaf{node: node, rank: rank, gen: gen, page: page})
+	}
+
+	for page := uint64(1); page < s.nPage; page++ {
+		data := s.readPage(page)
+		if data == nil {
+			continue
+		}
+		if s.db.Compress {
+			add(extentPtr(page*PAGE_SECTORS, PAGE_SECTORS), page, data)
+		} else {
+			add(page, page, data)
+		}
+
+		// compressed extents start with the magic at sector boundaries
+		for sector := uint64(0); sector < PAGE_SECTORS; sector++ {
+			extent := data[sector*SECTOR_SIZE:]
+			if binary.LittleEndian.Uint16(extent) != EXTENT_MAGIC {
+				continue
+			}
+			nSector := (EXTENT_HEADER + int(binary.LittleEndian.Uint16(extent[2:])) + SECTOR_SIZE - 1) / SECTOR_SIZE
+			if int(sector)+nSector > PAGE_SECTORS {
+				continue
+			}
+			node, err := s.db.extent.codec.decompress(extent[:nSector*SECTOR_SIZE])
+			if err == nil {
+				add(extentPtr(page*PAGE_SECTORS+sector, nSector), page, node)
+			}
+		}
+	}
+	return leaves
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"bytes"
+	"syscall"
+	"unsafe"
+)
+
+/*
+
+Scans and madvise hints
+
+Scan walks the KVs of a range in key order with a bptree.Iter, whose leaves are scattered in the file. Each leaf the
+iterator enters passes the following leaves of its parent to prefetch, which advises the next DB.Readahead of them
+MADV_WILLNEED, so the kernel reads them while the scan is still busy with the leaf, instead of faulting them in one at
+a time. Pages are advised once per scan.
+
+Point lookups read a single path of the tree, and the readahead of the kernel on a page fault mostly reads pages which
+are not needed, so the mmap is advised MADV_RANDOM unless DB.NoRandomAdvice. Scans are not slowed down by it, since
+they advise their own readahead.
+
+The buffer pool has no mmap to advise, so the hints only apply to the mmap. Nodes are copied out of their frames, so
+a scan replaces frames of the leaves it moved past, and never grows the pool, see pool.go.
+
+*/
+
+const READAHEAD_LEAVES = 8 // leaves prefetched ahead of a scan by default
+
+// Scan calls fn with the KVs whose keys are in [start, end) in key order, until fn returns false. A nil start is the
+// first key, and a nil end is past the last key. The KVs are only valid during the call, and fn must not call the
+// database.
+func (db *DB) Scan(start, end []byte, fn func(key, val []byte) bool) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverCorrupt(db, metaPageEncode(db), &err)
+
+	db.readahead = map[uint64]bool{}
+	defer func() { db.readahead = nil }()
+	for iter := db.tree.SeekGE(start); iter.Valid(); iter.Next() {
+		if end != nil && bytes.Compare(iter.Key(), end) >= 0 {
+			break
+		}
+		if !fn(iter.Key(), iter.Val()) {
+			break
+		}
+	}
+	return nil
+}
+
+// prefetch is the Prefetch callback of the tree, which advises the pages of the next leaves of a scan.
+func (db *DB) prefetch(ptrs []uint64) {
+	n := db.Readahead
+	if n == 0 {
+		n = READAHEAD_LEAVES
+	}
+	if db.pool != nil || db.readahead == nil || n < 0 {
+		return
+	}
+	for _, ptr := range ptrs[:min(n, len(ptrs))] {
+		page := pageOf(db, ptr)
+		if db.readahead[page] {
+			continue
+		}
+		db.readahead[page] = true
+		if data := mmapPage(db, page); data != nil {
+			_ = madvise(data, syscall.MADV_WILLNEED) // only a hint
+			db.stats.readahead++
+		}
+	}
+}
+
+// mmapAdvise advises a new chunk of the mmap for point lookups.
+func mmapAdvise(db *DB, chunk []byte) {
+	if !db.NoRandomAdvice {
+		_ = madvise(chunk, syscall.MADV_RANDOM)
+	}
+}
+
+// madvise advises the kernel about the use of mapped memory, which syscall only provides on Linux.
+func madvise(b []byte, advice int) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(advice))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+/*
+
+Spilling pending pages
+
+Pending pages of a commit are kept in memory until writePages, so a commit rewriting many pages, such as Rekey, holds
+all of them. With DB.SpillPages, pending pages beyond the amount spill to a scratch file next to the database file,
+oldest first, and are read back by pageGet and writePages. A spilled page stays in the updates as an empty page, which
+tells it from a freed page, which is nil.
+The scratch file stores what writePages writes: the node, or its extent including the header with compression.
+
+Pages of encrypted files are sealed in the scratch file with a key generated when the file is opened, which is never
+stored. The scratch file is truncated after every commit, and removed on Close.
+
+*/
+
+const SPILL_SUFFIX = ".spill"
+
+// spillSlot locates a spilled page in the scratch file.
+type spillSlot struct {
+	offset int64
+	size   int
+	nonce  uint64 // nonce of a sealed page, 0 if not sealed
+}
+
+// spilled is the page stored in the updates for spilled pages.
+var spilled = []byte{}
+
+// pageSpilled reports whether a page of the updates is spilled.
+func pageSpilled(page []byte) bool {
+	return page != nil && len(page) == 0
+}
+
+// pageStore stores a pending node, and its extent with compression, spilling the oldest pending pages in memory
+// beyond DB.SpillPages.
+func pageStore(db *DB, ptr uint64, node bptree.Node, encoded []byte) {
+	pageForget(db, ptr)
+	db.page.updates[ptr] = node
+	if db.Compress {
+		db.extent.encoded[ptr] = encoded
+	}
+	if db.SpillPages <= 0 {
+		return
+	}
+
+	db.spill.pages++
+	db.spill.queue = append(db.spill.queue, ptr)
+	for db.spill.pages > db.SpillPages && !db.spill.failed && len(db.spill.queue) > 0 {
+		victim := db.spill.queue[0]
+		db.spill.queue = db.spill.queue[1:]
+		if len(db.page.updates[victim]) == 0 {
+			continue // freed, or spilled since queued again
+		}
+		if err := spillWrite(db, victim); err != nil {
+			// pages are kept in memory until the commit
+			db.spill.failed = true
+		}
+	}
+}
+
+// pageForget drops the pending page of a pointer from the accounting of spilled pages.
+func pageForget(db *DB, ptr uint64) {
+	page, ok := db.page.updates[ptr]
+	if !ok || page == nil {
+		return
+	}
+	if pageSpilled(page) {
+		delete(db.spill.slots, ptr)
+	} else if db.SpillPages > 0 {
+		db.spill.pages--
+	}
+}
+
+// spillWrite moves a pending page in memory to the scratch file.
+func spillWrite(db *DB, ptr uint64) error {
+	data := db.page.updates[ptr][:bptree.PAGE_SIZE]
+	if db.Compress {
+		data = db.extent.encoded[ptr]
+	}
+
+	if db.spill.fp == nil {
+		// a scratch file left by a crash is overwritten
+		fp, err := os.OpenFile(db.Path+SPILL_SUFFIX, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("spillWrite: %w", err)
+		}
+		db.spill.fp = fp
+	}
+
+	slot := spillSlot{offset: db.spill.size}
+	if db.enc.read != nil || db.enc.write != nil {
+		if db.spill.aead == nil {
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return fmt.Errorf("spillWrite: %w", err)
+			}
+			aead, _, err := encryptCipher(key)
+			if err != nil {
+				return fmt.Errorf("spillWrite: %w", err)
+			}
+			db.spill.aead = aead
+		}
+		db.spill.nonce++
+		slot.nonce = db.spill.nonce
+		data = db.spill.aead.Seal(nil, spillNonce(slot.nonce), data, nil)
+	}
+	slot.size = len(data)
+	if _, err := syscall.Pwrite(int(db.spill.fp.Fd()), data, slot.offset); err != nil {
+		return fmt.Errorf("spillWrite: %w", err)
+	}
+
+	if db.spill.slots == nil {
+		db.spill.slots = map[uint64]spillSlot{}
+	}
+	db.spill.slots[ptr] = slot
+	db.spill.size += int64(slot.size)
+	db.spill.pages--
+	db.stats.spilled++
+	db.page.updates[ptr] = spilled
+	delete(db.extent.encoded, ptr)
+	return nil
+}
+
+// spillRead returns what writePages writes for a spilled page.
+func spillRead(db *DB, ptr uint64) ([]byte, error) {
+	slot, ok := db.spill.slots[ptr]
+	if !ok {
+		return nil, errors.New("spillRead: page is not spilled")
+	}
+	data := make([]byte, slot.size)
+	if _, err := db.spill.fp.ReadAt(data, slot.offset); err != nil {
+		return nil, fmt.Errorf("spillRead: %w", err)
+	}
+	if slot.nonce != 0 {
+		plain, err := db.spill.aead.Open(data[:0], spillNonce(slot.nonce), data, nil)
+		if err != nil {
+			return nil, errors.New("spillRead: authentication failed")
+		}
+		data = plain
+	}
+	return data, nil
+}
+
+// spillGet returns the node of a spilled page, and panics with ErrCorruptPage if it cannot be read back.
+func spillGet(db *DB, ptr uint64) bptree.Node {
+	data, err := spillRead(db, ptr)
+	if err == nil && db.Compress {
+		data, err = db.extent.codec.decompress(data)
+	}
+	if err != nil {
+		panic(&ErrCorruptPage{Page: pageOf(db, ptr), Reason: err.Error()})
+	}
+	return data
+}
+
+func spillNonce(n uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint64(nonce, n)
+	return nonce
+}
+
+// spillDiscard forgets spilled pages, and truncates the scratch file.
+func spillDiscard(db *DB) {
+	if db.spill.fp != nil && db.spill.size > 0 {
+		// later pages overwrite the file if it fails
+		_ = db.spill.fp.Truncate(0)
+	}
+	db.spill.size = 0
+	db.spill.slots = nil
+	db.spill.queue = nil
+	db.spill.pages = 0
+	db.spill.failed = false
+}
+
+// spillClose closes and removes the scratch file.
+func spillClose(db *DB) {
+	if db.spill.fp == nil {
+		return
+	}
+	_ = db.spill.fp.Close()
+	_ = os.Remove(db.Path + SPILL_SUFFIX)
+	db.spill.fp = nil
+}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+
+Statistics
+
+Stats walks the B+ tree and the freelists, and reports the shape of the tree, how full its nodes are, and how much of
+the file is live. Pager counters are kept since the file is opened.
+
+*/
+
+// Stats is the result of DB.Stats.
+type Stats struct {
+	Height    int
+	Levels    []LevelStats // from the root
+	Internals int          // internal nodes
+	Leaves    int          // leaf nodes
+	Keys      int          // keys in leaves, not counting the dummy key
+	KeyBytes  int64
+	ValBytes  int64
+
+	FileSize  int64
+	Pages     uint64 // flushed pages including the meta page
+	LivePages uint64 // pages holding reachable nodes, including the meta page
+	FreeNodes int    // freelist nodes
+	Free      int    // free pages, or extents with compression
+
+	PagesWritten uint64 // pages written since opened
+	Fsyncs       uint64 // fsyncs of the file and its sidecar files since opened
+	Commits      uint64 // commits since opened
+	Readahead    uint64 // pages advised ahead of scans since opened
+	Spilled      uint64 // pending pages spilled to the scratch file since opened, see spill.go
+	MmapChunks   int
+	MmapSize     int
+	PoolFrames   int    // frames of the buffer pool, see pool.go
+	PoolHits     uint64 // pages found in the buffer pool since opened
+	PoolMisses   uint64 // pages read into the buffer pool since opened
+	PoolEvicts   uint64 // pages replaced in the buffer pool since opened
+}
+
+// LevelStats describes the nodes of a level of the tree.
+type LevelStats struct {
+	Nodes int
+	Bytes int64   // used bytes of nodes
+	Fill  float64 // average fill factor of nodes
+}
+
+func (s *Stats) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "tree: height %d, %d internal nodes, %d leaves\n", s.Height, s.Internals, s.Leaves)
+	for i, level := range s.Levels {
+		fmt.Fprintf(&b, "  level %d: %d nodes, %d bytes, fill %.1f%%\n", i, level.Nodes, level.Bytes, 100*level.Fill)
+	}
+	fmt.Fprintf(&b, "keys: %d, %d key bytes, %d value bytes\n", s.Keys, s.KeyBytes, s.ValBytes)
+	fmt.Fprintf(&b, "file: %d bytes, %d pages, %d live pages\n", s.FileSize, s.Pages, s.LivePages)
+	fmt.Fprintf(&b, "freelist: %d nodes, %d free\n", s.FreeNodes, s.Free)
+	fmt.Fprintf(&b, "pager: %d pages written, %d fsyncs, %d commits, %d pages read ahead, %d pages spilled, "+
+		"%d mmap chunks of %d bytes\n", s.PagesWritten, s.Fsyncs, s.Commits, s.Readahead, s.Spilled, s.MmapChunks,
+		s.MmapSize)
+	if s.PoolFrames > 0 {
+		fmt.Fprintf(&b, "buffer pool: %d frames, %d hits, %d misses, %d evictions\n",
+			s.PoolFrames, s.PoolHits, s.PoolMisses, s.PoolEvicts)
+	}
+	return b.String()
+}
+
+// Stats walks the file and returns its statistics.
+func (db *DB) Stats() (s *Stats, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer recoverCorrupt(db, metaPageEncode(db), &err)
+
+	s = &Stats{
+		FileSize:     int64(db.fsize),
+		Pages:        db.page.nFlushed,
+		PagesWritten: db.stats.written,
+		Fsyncs:       db.stats.fsyncs,
+		Commits:      db.stats.commits,
+		Readahead:    db.stats.readahead,
+		Spilled:      db.stats.spilled,
+		MmapChunks:   len(db.mmap.chunks),
+		MmapSize:     db.mmap.size,
+	}
+	if db.Compress {
+		s.Pages /= PAGE_SECTORS
+	}
+	if p := db.pool; p != nil {
+		s.PoolFrames, s.PoolHits, s.PoolMisses, s.PoolEvicts = len(p.frames), p.hits, p.misses, p.evictions
+	}
+
+	live := map[uint64]bool{0: true}
+	var walk func(ptr uint64, depth int)
+	walk = func(ptr uint64, depth int) {
+		node := db.tree.Get(ptr)
+		live[pageOf(db, ptr)] = true
+		if depth == len(s.Levels) {
+			s.Levels = append(s.Levels, LevelStats{})
+		}
+		level := &s.Levels[depth]
+		level.Nodes++
+		level.Bytes += int64(node.Size())
+
+		if node.Type() == bptree.BNODE_LEAF {
+			s.Leaves++
+			s.Keys += int(node.NumKeys())
+			for i := uint16(0); i < node.NumKeys(); i++ {
+				s.KeyBytes += int64(len(node.Key(i)))
+				s.ValBytes += int64(len(node.Val(i)))
+			}
+			return
+		}
+		s.Internals++
+		for i := uint16(0); i < node.NumKeys(); i++ {
+			walk(node.Ptr(i), depth+1)
+		}
+	}
+	if db.tree.Root != 0 {
+		walk(db.tree.Root, 0)
+		s.Keys-- // the dummy key
+	}
+	s.Height = len(s.Levels)
+	s.LivePages = uint64(len(live))
+	for i := range s.Levels {
+		s.Levels[i].Fill = float64(s.Levels[i].Bytes) / float64(s.Levels[i].Nodes*bptree.PAGE_SIZE)
+	}
+
+	fls := []*FreeList{&db.fl}
+	for i := range db.extent.fl {
+		fls = append(fls, &db.extent.fl[i])
+	}
+	for _, fl := range fls {
+		for ptr := fl.head; ptr != 0; {
+			node := fl.get(ptr)
+			s.FreeNodes++
+			s.Free += flnSize(node)
+			ptr = flnNext(node)
+		}
+	}
+	s.Free += len(db.backup.freed)
+	return s, nil
+}
+
+// fileSync syncs the file or a sidecar file, counting fsyncs.
+func fileSync(db *DB, fp *os.File) error {
+	db.stats.fsyncs++
+	defer func(start time.Time) { db.Observer.Fsync(time.Since(start)) }(time.Now())
+	return fp.Sync()
+}
@@ -0,0 +1,318 @@
+package database
+
+import (
+	"MiSQL/bptree"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+/*
+
+io_uring
+
+With DB.IOUring, the pages written by a commit are not written one pwrite at a time: they are queued, and submitted to
+an io_uring together with the fsyncs of the file and of its sidecar files, the first of which drains the writes before
+it. The meta page is then written by a second submission, linked to its fsync, so it is only written once every page
+of the commit is durable, as with pwrite. A commit writing more pages than the ring holds is submitted in batches.
+
+The ring is set up with the raw syscalls, without liburing. Writes of sidecar files are small and stay pwrites.
+
+*/
+
+const (
+	RING_ENTRIES = 256 // entries of the submission queue
+
+	SYS_IO_URING_SETUP = 425
+	SYS_IO_URING_ENTER = 426
+
+	IORING_OFF_SQ_RING      = 0
+	IORING_OFF_CQ_RING      = 0x8000000
+	IORING_OFF_SQES         = 0x10000000
+	IORING_FEAT_SINGLE_MMAP = 1 << 0
+	IORING_ENTER_GETEVENTS  = 1 << 0
+
+	IORING_OP_FSYNC = 3
+	IORING_OP_WRITE = 23
+
+	IOSQE_IO_DRAIN = 1 << 1
+	IOSQE_IO_LINK  = 1 << 2
+
+	SQE_SIZE = 64
+	CQE_SIZE = 16
+)
+
+// ringParams is struct io_uring_params.
+type ringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  struct {
+		head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+		userAddr                                                        uint64
+	}
+	cqOff struct {
+		head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+		userAddr                                                        uint64
+	}
+}
+
+// uring is an io_uring, and the writes queued by the current commit.
+type uring struct {
+	fd      int
+	sqRing  []byte
+	cqRing  []byte
+	sqes    []byte
+	params  ringParams
+	single  bool // whether both rings are mapped at once
+	active  bool // whether writes are queued, between ringBegin and ringEnd
+	pending []ringWrite
+	pages   map[uint64][]int  // pending writes by page
+	whole   map[uint64][]byte // pages queued as a whole by direct I/O, see ringPage
+}
+
+type ringWrite struct {
+	data   []byte
+	offset int64
+}
+
+// ringOpen sets up the io_uring of the file.
+func ringOpen(db *DB) error {
+	r := &uring{}
+	fd, _, errno := syscall.Syscall(SYS_IO_URING_SETUP, RING_ENTRIES, uintptr(unsafe.Pointer(&r.params)), 0)
+	if errno != 0 {
+		return fmt.Errorf("ringOpen: io_uring_setup: %w", errno)
+	}
+	r.fd = int(fd)
+	db.ring = r
+
+	p := &r.params
+	sqSize := int(p.sqOff.array + 4*p.sqEntries)
+	cqSize := int(p.cqOff.cqes + CQE_SIZE*p.cqEntries)
+	r.single = p.features&IORING_FEAT_SINGLE_MMAP != 0
+	if r.single {
+		sqSize = max(sqSize, cqSize)
+	}
+	var err error
+	flags := syscall.MAP_SHARED | syscall.MAP_POPULATE
+	rw := syscall.PROT_READ | syscall.PROT_WRITE
+	if r.sqRing, err = syscall.Mmap(r.fd, IORING_OFF_SQ_RING, sqSize, rw, flags); err != nil {
+		return fmt.Errorf("ringOpen: %w", err)
+	}
+	r.cqRing = r.sqRing
+	if !r.single {
+		if r.cqRing, err = syscall.Mmap(r.fd, IORING_OFF_CQ_RING, cqSize, rw, flags); err != nil {
+			return fmt.Errorf("ringOpen: %w", err)
+		}
+	}
+	if r.sqes, err = syscall.Mmap(r.fd, IORING_OFF_SQES, int(SQE_SIZE*p.sqEntries), rw, flags); err != nil {
+		return fmt.Errorf("ringOpen: %w", err)
+	}
+	return nil
+}
+
+// ringClose tears down the io_uring.
+func ringClose(db *DB) {
+	r := db.ring
+	if r == nil {
+		return
+	}
+	if !r.single && r.cqRing != nil {
+		_ = syscall.Munmap(r.cqRing)
+	}
+	for _, m := range [][]byte{r.sqes, r.sqRing} {
+		if m != nil {
+			_ = syscall.Munmap(m)
+		}
+	}
+	_ = syscall.Close(r.fd)
+	db.ring = nil
+}
+
+// ringBegin starts queueing the writes of a commit.
+func ringBegin(db *DB) {
+	if db.ring != nil {
+		db.ring.active = true
+		db.ring.pending = db.ring.pending[:0]
+		db.ring.pages, db.ring.whole = map[uint64][]int{}, map[uint64][]byte{}
+	}
+}
+
+// ringEnd stops queueing writes, dropping the writes not submitted by a failed commit.
+func ringEnd(db *DB) {
+	if db.ring != nil {
+		db.ring.active = false
+		db.ring.pending = nil
+		db.ring.pages, db.ring.whole = nil, nil
+	}
+}
+
+// ringActive returns whether writes are queued.
+func ringActive(db *DB) bool {
+	return db.ring != nil && db.ring.active
+}
+
+// ringQueue queues a write of the file, which returns false if writes are not queued.
+func ringQueue(db *DB, data []byte, offset int64) bool {
+	if !ringActive(db) {
+		return false
+	}
+	page := uint64(offset / bptree.PAGE_SIZE)
+	db.ring.pages[page] = append(db.ring.pages[page], len(db.ring.pending))
+	db.ring.pending = append(db.ring.pending, ringWrite{data: data, offset: offset})
+	return true
+}
+
+// ringPage returns the buffer queued to write a page as a whole with direct I/O, which the later writes of the commit
+// to the page are made into, so that a page is not written twice by a submission. The rest of the page is read into
+// the buffer if read is set.
+func ringPage(db *DB, page uint64, read bool) []byte {
+	if buf, ok := db.ring.whole[page]; ok {
+		return buf
+	}
+	buf := alignedBuf(bptree.PAGE_SIZE)
+	if read {
+		copy(buf, pageRaw(db, page))
+	}
+	db.ring.whole[page] = buf
+	ringQueue(db, buf, int64(page*bptree.PAGE_SIZE))
+	return buf
+}
+
+// ringOverlay returns the content of a page once its queued writes are made, given its content on disk.
+func ringOverlay(db *DB, page uint64, raw []byte) []byte {
+	if !ringActive(db) || len(db.ring.pages[page]) == 0 {
+		return raw
+	}
+	data := bytes.Clone(raw)
+	for _, i := range db.ring.pages[page] {
+		w := db.ring.pending[i]
+		copy(data[w.offset%bptree.PAGE_SIZE:], w.data)
+	}
+	return data
+}
+
+// ringSync submits the queued writes, then fsyncs the files which are not nil. A single write is linked to the fsyncs,
+// otherwise the first fsync drains the writes.
+func ringSync(db *DB, fps ...*os.File) error {
+	r := db.ring
+	start := time.Now()
+	fds := []int{}
+	for _, fp := range fps {
+		if fp != nil {
+			fds = append(fds, int(fp.Fd()))
+		}
+	}
+
+	all, pending := r.pending, r.pending
+	r.pending, r.pages, r.whole = nil, map[uint64][]int{}, map[uint64][]byte{}
+	for len(pending) > int(r.params.sqEntries)-len(fds) {
+		n := int(r.params.sqEntries)
+		if err := ringSubmit(r, int(db.fp.Fd()), pending[:n], nil); err != nil {
+			return fmt.Errorf("ringSync: %w", err)
+		}
+		pending = pending[n:]
+	}
+	if err := ringSubmit(r, int(db.fp.Fd()), pending, fds); err != nil {
+		return fmt.Errorf("ringSync: %w", err)
+	}
+	// pages read into the buffer pool while the writes were queued are stale
+	for _, w := range all {
+		poolWritten(db, uint64(w.offset/bptree.PAGE_SIZE), int(w.offset%bptree.PAGE_SIZE), w.data)
+	}
+
+	db.stats.fsyncs += uint64(len(fds))
+	for range fds {
+		db.Observer.Fsync(time.Since(start))
+	}
+	return nil
+}
+
+// ringSubmit submits writes of a file followed by fsyncs, and waits for them to complete.
+func ringSubmit(r *uring, file int, writes []ringWrite, fds []int) error {
+	n := len(writes) + len(fds)
+	if n == 0 {
+		return nil
+	}
+	pinner := runtime.Pinner{}
+	defer pinner.Unpin()
+
+	p := &r.params
+	tail := (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	mask := *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	t := atomic.LoadUint32(tail)
+	for i := range n {
+		idx := (t + uint32(i)) & mask
+		sqe := r.sqes[SQE_SIZE*idx : SQE_SIZE*(idx+1)]
+		clear(sqe)
+		if i < len(writes) {
+			w := writes[i]
+			pinner.Pin(&w.data[0])
+			sqe[0] = IORING_OP_WRITE
+			*(*int32)(unsafe.Pointer(&sqe[4])) = int32(file)
+			*(*uint64)(unsafe.Pointer(&sqe[8])) = uint64(w.offset)
+			*(*uint64)(unsafe.Pointer(&sqe[16])) = uint64(uintptr(unsafe.Pointer(&w.data[0])))
+			*(*uint32)(unsafe.Pointer(&sqe[24])) = uint32(len(w.data))
+			if len(writes) == 1 && len(fds) > 0 {
+				sqe[1] = IOSQE_IO_LINK
+			}
+		} else {
+			sqe[0] = IORING_OP_FSYNC
+			*(*int32)(unsafe.Pointer(&sqe[4])) = int32(fds[i-len(writes)])
+			if i == len(writes) && len(writes) > 1 {
+				sqe[1] = IOSQE_IO_DRAIN
+			}
+		}
+		*(*uint64)(unsafe.Pointer(&sqe[32])) = uint64(i)
+		*(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array+4*idx])) = idx
+	}
+	atomic.StoreUint32(tail, t+uint32(n))
+
+	submitted, completed := 0, 0
+	results := make([]int32, n)
+	for completed < n {
+		got, _, errno := syscall.Syscall6(SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(n-submitted),
+			uintptr(n-completed), IORING_ENTER_GETEVENTS, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return fmt.Errorf("io_uring_enter: %w", errno)
+		}
+		submitted += int(got)
+		completed += ringReap(r, results)
+	}
+
+	for i, res := range results {
+		if res < 0 {
+			return syscall.Errno(-res)
+		}
+		if i < len(writes) && int(res) < len(writes[i].data) {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+// ringReap consumes completions, and returns their amount.
+func ringReap(r *uring, results []int32) int {
+	p := &r.params
+	head := (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	tail := atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail])))
+	mask := *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	h := atomic.LoadUint32(head)
+	n := 0
+	for ; h != tail; h++ {
+		cqe := r.cqRing[p.cqOff.cqes+CQE_SIZE*(h&mask):]
+		i := *(*uint64)(unsafe.Pointer(&cqe[0]))
+		results[i] = *(*int32)(unsafe.Pointer(&cqe[8]))
+		n++
+	}
+	atomic.StoreUint32(head, h)
+	return n
+}
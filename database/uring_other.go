@@ -0,0 +1,27 @@
+//go:build !linux
+
+package database
+
+import (
+	"errors"
+	"os"
+)
+
+// RING_ENTRIES is the size of the ring on Linux.
+const RING_ENTRIES = 256
+
+// uring is only available on Linux.
+type uring struct{}
+
+func ringOpen(db *DB) error {
+	return errors.New("ringOpen: io_uring is only available on Linux")
+}
+
+func ringClose(db *DB)                                   {}
+func ringBegin(db *DB)                                   {}
+func ringEnd(db *DB)                                     {}
+func ringActive(db *DB) bool                             { return false }
+func ringQueue(db *DB, data []byte, offset int64) bool   { return false }
+func ringPage(db *DB, page uint64, read bool) []byte     { return nil }
+func ringOverlay(db *DB, page uint64, raw []byte) []byte { return raw }
+func ringSync(db *DB, fps ...*os.File) error             { return nil }